@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The /api/v1 endpoints take and return JSON only and accept an API token
+// with the route's scope or the dashboard's basic auth. Every error is an
+// APIErrorResponse with a stable code, so clients branch on the code and
+// show the message. The routes are listed once in apiV1Routes, which both
+// registers the handlers and generates the OpenAPI spec served at
+// /api/v1/openapi.json. The unversioned endpoints stay for the dashboard.
+const (
+	codeInvalidRequest      = "invalid_request"
+	codeInvalidRows         = "invalid_rows"
+	codeClawbackUnconfirmed = "clawback_not_confirmed"
+	codeNothingToDisburse   = "nothing_to_disburse"
+	codePlanChanged         = "plan_changed"
+	codeUnauthorized        = "unauthorized"
+	codeForbidden           = "forbidden"
+	codeNotFound            = "not_found"
+	codeConflict            = "conflict"
+	codeUpstream            = "upstream_error"
+	codeInternal            = "internal_error"
+	codeShuttingDown        = "shutting_down"
+)
+
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// PlanRequest describes a plan. Custom plans send amount to every event the
+// target selects; upload plans send each row's amount to its event.
+type PlanRequest struct {
+	Mode   string      `json:"mode"`
+	Amount float64     `json:"amount,omitempty"`
+	Target EventTarget `json:"target,omitempty"`
+	Rows   []UploadRow `json:"rows,omitempty"`
+	Name   string      `json:"name,omitempty"`
+	Memo   string      `json:"memo,omitempty"`
+}
+
+// RunRequest plans and executes a run. Custom runs that claw money back
+// need confirm_clawback.
+type RunRequest struct {
+	PlanRequest
+	Exclusions      []ExclusionRequest `json:"exclusions,omitempty"`
+	Expected        []ExpectedItem     `json:"expected,omitempty"`
+	ConfirmClawback bool               `json:"confirm_clawback,omitempty"`
+}
+
+// ExclusionRequest leaves an event out of a run; the reason is required.
+type ExclusionRequest struct {
+	RecordID string `json:"record_id"`
+	Reason   string `json:"reason"`
+}
+
+type RunList struct {
+	Runs []Run `json:"runs"`
+}
+
+type DeliveryList struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+// ClawbackSummary is the detail of a clawback_not_confirmed error.
+type ClawbackSummary struct {
+	Count int     `json:"count"`
+	Total float64 `json:"total"`
+}
+
+// apiRoute is one /api/v1 endpoint. Path uses gin's syntax and is relative
+// to /api/v1; Scope is the token scope it needs; Body and Response are zero
+// values of the JSON types, used for the spec.
+type apiRoute struct {
+	Method   string
+	Path     string
+	Summary  string
+	Scope    string
+	Query    []apiParam
+	Body     interface{}
+	Status   int
+	Response interface{}
+	Errors   []int
+	Handler  gin.HandlerFunc
+}
+
+type apiParam struct {
+	Name        string
+	Description string
+}
+
+var historyParams = []apiParam{
+	{"run", "Run ID"},
+	{"status", "processed, failed, unknown, or the transfer state submitted, completed or rejected"},
+	{"type", "autogrant, withdrawal, miscellaneous or clawback"},
+	{"event", "Part of an hcb_event_id, or an event record ID"},
+	{"operator", "Part of the operator's name"},
+	{"from", "First day, YYYY-MM-DD"},
+	{"to", "Last day, YYYY-MM-DD"},
+}
+
+func apiV1Routes() []apiRoute {
+	return []apiRoute{
+		{Method: "POST", Path: "/plans", Scope: scopePlan, Summary: "Preview the plan for a run without sending anything",
+			Body: PlanRequest{}, Status: 200, Response: Plan{}, Errors: []int{400, 422, 502},
+			Handler: handleV1CreatePlan},
+		{Method: "GET", Path: "/runs", Scope: scopeRead, Summary: "List runs, newest first",
+			Query:  []apiParam{{"status", "Only runs with this status"}},
+			Status: 200, Response: RunList{}, Errors: []int{500},
+			Handler: handleV1ListRuns},
+		{Method: "POST", Path: "/runs", Scope: scopeExecute, Summary: "Plan and execute a run",
+			Body: RunRequest{}, Status: 201, Response: Run{}, Errors: []int{400, 409, 422, 500, 502, 503},
+			Handler: handleV1CreateRun},
+		{Method: "GET", Path: "/runs/:id", Scope: scopeRead, Summary: "Get a run",
+			Status: 200, Response: Run{}, Errors: []int{404, 500},
+			Handler: handleV1GetRun},
+		{Method: "POST", Path: "/runs/:id/approve", Scope: scopeExecute, Summary: "Approve and execute a scheduled run awaiting approval",
+			Status: 200, Response: Run{}, Errors: []int{404, 409, 500, 502, 503},
+			Handler: handleV1RunAction(approveRun, true)},
+		{Method: "POST", Path: "/runs/:id/reject", Scope: scopeExecute, Summary: "Reject a scheduled run awaiting approval",
+			Status: 200, Response: Run{}, Errors: []int{404, 409, 500},
+			Handler: handleV1RunAction(rejectRun, false)},
+		{Method: "POST", Path: "/runs/:id/resume", Scope: scopeExecute, Summary: "Resume a run interrupted by shutdown",
+			Status: 200, Response: Run{}, Errors: []int{404, 409, 500, 503},
+			Handler: handleV1RunAction(resumeRun, true)},
+		{Method: "POST", Path: "/runs/:id/retry", Scope: scopeExecute, Summary: "Re-send the failed disbursements of a run that are safe to retry, as a new run",
+			Status: 201, Response: Run{}, Errors: []int{404, 409, 422, 500, 503},
+			Handler: handleV1RetryRun},
+		{Method: "GET", Path: "/disbursements", Scope: scopeRead, Summary: "List disbursements from the run history, newest first",
+			Query:  append(historyParams, apiParam{"page", "Page number, from 1"}, apiParam{"per_page", "Page size, at most 200"}),
+			Status: 200, Response: DisbursementPage{}, Errors: []int{400, 500},
+			Handler: handleV1ListDisbursements},
+		{Method: "GET", Path: "/disbursements/:id", Scope: scopeRead, Summary: "Get a disbursement by its Airtable record ID, with the Airtable record and the HCB transfer",
+			Status: 200, Response: DisbursementDetail{}, Errors: []int{404, 500, 502},
+			Handler: handleV1GetDisbursement},
+		{Method: "GET", Path: "/events/:hcb_event_id/timeline", Scope: scopeRead, Summary: "Everything sent to or taken from an HCB organization",
+			Status: 200, Response: EventTimeline{}, Errors: []int{400, 500},
+			Handler: handleV1EventTimeline},
+		{Method: "GET", Path: "/webhooks/deliveries", Scope: scopeRead, Summary: "List webhook deliveries",
+			Query:  []apiParam{{"status", "pending, delivered or failed"}},
+			Status: 200, Response: DeliveryList{}, Errors: []int{500},
+			Handler: handleV1ListDeliveries},
+		{Method: "POST", Path: "/webhooks/deliveries/:id/redeliver", Scope: scopeExecute, Summary: "Send a webhook delivery again",
+			Status: 200, Response: WebhookDelivery{}, Errors: []int{404},
+			Handler: handleV1Redeliver},
+		{Method: "GET", Path: "/openapi.json", Scope: scopeRead, Summary: "This specification",
+			Status: 200, Response: map[string]interface{}{},
+			Handler: handleOpenAPI},
+	}
+}
+
+func registerAPIv1(group *gin.RouterGroup) {
+	for _, route := range apiV1Routes() {
+		group.Handle(route.Method, route.Path, apiAuth(route.Scope), logUser(), route.Handler)
+	}
+}
+
+// apiFail writes an error response; details may be nil.
+func apiFail(c *gin.Context, status int, code, message string, details interface{}) {
+	c.AbortWithStatusJSON(status, APIErrorResponse{APIError{Code: code, Message: message, Details: details}})
+}
+
+// handleNoRoute answers unknown /api/v1 paths with a JSON error.
+func handleNoRoute(c *gin.Context) {
+	if strings.HasPrefix(c.Request.URL.Path, "/api/v1/") {
+		apiFail(c, 404, codeNotFound, fmt.Sprintf("No endpoint %s %s", c.Request.Method, c.Request.URL.Path), nil)
+		return
+	}
+	c.String(404, "404 page not found")
+}
+
+// bindJSON decodes the request body into v, refusing unknown fields so a
+// misspelt option is never silently ignored.
+func bindJSON(c *gin.Context, v interface{}) bool {
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		apiFail(c, 400, codeInvalidRequest, fmt.Sprintf("The request body must be a JSON object: %v", err), nil)
+		return false
+	}
+	return true
+}
+
+func apiDraining(c *gin.Context) bool {
+	if isDraining() {
+		apiFail(c, 503, codeShuttingDown, "Server is shutting down; try again shortly", nil)
+		return true
+	}
+	return false
+}
+
+// exclusionReasons turns exclusions into the reasons excludeEvents takes.
+func exclusionReasons(exclusions []ExclusionRequest) (map[string]string, error) {
+	reasons := make(map[string]string)
+	for _, exclusion := range exclusions {
+		reason := strings.TrimSpace(exclusion.Reason)
+		if exclusion.RecordID == "" || reason == "" {
+			return nil, fmt.Errorf("every excluded event needs a record_id and a reason")
+		}
+		reasons[exclusion.RecordID] = reason
+	}
+	return reasons, nil
+}
+
+// apiPlan builds the plan a request describes. On failure it writes the
+// response and returns false.
+func apiPlan(c *gin.Context, req PlanRequest) (Plan, bool) {
+	switch req.Mode {
+	case "autogrant":
+		if req.Amount != 0 || !req.Target.isDefault() || len(req.Rows) > 0 {
+			apiFail(c, 400, codeInvalidRequest, "Autogrant plans take no amount, target or rows", nil)
+			return Plan{}, false
+		}
+
+	case "custom":
+		if req.Amount == 0 {
+			apiFail(c, 400, codeInvalidRequest, "Custom plans need a non-zero amount", nil)
+			return Plan{}, false
+		}
+		if len(req.Rows) > 0 {
+			apiFail(c, 400, codeInvalidRequest, "Custom plans take no rows; use the upload mode", nil)
+			return Plan{}, false
+		}
+		if err := req.Target.validate(); err != nil {
+			apiFail(c, 400, codeInvalidRequest, err.Error(), nil)
+			return Plan{}, false
+		}
+
+	case "upload":
+		if req.Amount != 0 || !req.Target.isDefault() {
+			apiFail(c, 400, codeInvalidRequest, "Upload plans take rows, not an amount or target", nil)
+			return Plan{}, false
+		}
+
+	default:
+		apiFail(c, 400, codeInvalidRequest, "mode must be autogrant, custom or upload", nil)
+		return Plan{}, false
+	}
+
+	plan, problems, err := req.build(c.Request.Context())
+	if errors.Is(err, errMissingRecords) {
+		apiFail(c, 400, codeInvalidRequest, err.Error(), nil)
+		return Plan{}, false
+	}
+	if err != nil {
+		apiFail(c, 502, codeUpstream, fmt.Sprintf("Failed to fetch events: %v", err), nil)
+		return Plan{}, false
+	}
+	if len(problems) > 0 {
+		apiFail(c, 422, codeInvalidRows, fmt.Sprintf("%d problems in the rows", len(problems)), problems)
+		return Plan{}, false
+	}
+	return plan, true
+}
+
+// build fetches the events a checked request needs and builds its plan, with
+// the problems in an upload's rows.
+func (req PlanRequest) build(ctx context.Context) (Plan, []string, error) {
+	target := EventTarget{}
+	if req.Mode == "custom" {
+		target = req.Target
+	}
+	events, err := getAllEvents(ctx, target)
+	if err != nil {
+		return Plan{}, nil, err
+	}
+
+	var plan Plan
+	var problems []string
+	switch req.Mode {
+	case "autogrant":
+		plan = buildAutograntPlan(ctx, events)
+	case "custom":
+		plan = buildCustomPlan(ctx, events, req.Amount, req.Target)
+	case "upload":
+		name := req.Name
+		if name == "" {
+			name = "api"
+		}
+		rows := make([]UploadRow, len(req.Rows))
+		for i, row := range req.Rows {
+			row.Line = i + 1
+			rows[i] = row
+		}
+		plan, problems = buildUploadPlan(ctx, events, rows, name)
+	}
+	plan.setMemo(strings.TrimSpace(req.Memo))
+	return plan, problems, nil
+}
+
+func handleV1CreatePlan(c *gin.Context) {
+	var req PlanRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	plan, ok := apiPlan(c, req)
+	if !ok {
+		return
+	}
+	c.JSON(200, plan)
+}
+
+func handleV1CreateRun(c *gin.Context) {
+	if apiDraining(c) {
+		return
+	}
+	var req RunRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	reasons, err := exclusionReasons(req.Exclusions)
+	if err != nil {
+		apiFail(c, 400, codeInvalidRequest, err.Error(), nil)
+		return
+	}
+	plan, ok := apiPlan(c, req.PlanRequest)
+	if !ok {
+		return
+	}
+
+	operator := c.GetString(gin.AuthUserKey)
+	plan.excludeEvents(reasons, operator)
+	if req.Expected != nil {
+		if diffs := plan.differences(req.Expected); len(diffs) > 0 {
+			apiFail(c, 409, codePlanChanged,
+				fmt.Sprintf("%d events differ from the expected plan; plan again before sending", len(diffs)), diffs)
+			return
+		}
+	}
+	if count, total := plan.clawbacks(); count > 0 && !req.ConfirmClawback {
+		apiFail(c, 422, codeClawbackUnconfirmed,
+			fmt.Sprintf("This run claws back $%.2f from %d events; resend with confirm_clawback to confirm", total, count),
+			ClawbackSummary{Count: count, Total: total})
+		return
+	}
+	if len(plan.Items) == 0 {
+		apiFail(c, 422, codeNothingToDisburse, "The plan has no events to disburse", nil)
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Starting API disbursement process", "mode", plan.Mode)
+	run := newRun(plan, "api", operator)
+	err = startRun(c.Request.Context(), run, func(ctx context.Context) (Plan, error) {
+		// Rows that no longer match an event drop out and show as differences
+		current, _, err := req.build(ctx)
+		current.excludeEvents(reasons, operator)
+		return current, err
+	})
+	var changed *planChangedError
+	switch {
+	case errors.As(err, &changed):
+		apiFail(c, 409, codePlanChanged,
+			fmt.Sprintf("%d events changed while another run was sending; plan again before sending", len(changed.differences)), changed.differences)
+		return
+	case errors.Is(err, errAirtable):
+		apiFail(c, 502, codeUpstream, err.Error(), nil)
+		return
+	case err != nil:
+		apiFail(c, 500, codeInternal, err.Error(), nil)
+		return
+	}
+	c.JSON(201, run)
+}
+
+func handleV1ListRuns(c *gin.Context) {
+	runs, err := runStore.List()
+	if err != nil {
+		apiFail(c, 500, codeInternal, fmt.Sprintf("Failed to load runs: %v", err), nil)
+		return
+	}
+
+	status := c.Query("status")
+	filtered := []Run{}
+	for _, run := range runs {
+		if status == "" || run.Status == status {
+			filtered = append(filtered, run)
+		}
+	}
+	c.JSON(200, RunList{Runs: filtered})
+}
+
+func handleV1GetRun(c *gin.Context) {
+	run, err := runStore.Get(c.Param("id"))
+	if err != nil {
+		apiRunError(c, err)
+		return
+	}
+	c.JSON(200, run)
+}
+
+// handleV1RunAction wraps approveRun, rejectRun and resumeRun. Actions that
+// execute the run are refused while draining.
+func handleV1RunAction(action func(ctx context.Context, id, operator string) (*Run, error), executes bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if executes && apiDraining(c) {
+			return
+		}
+		run, err := action(c.Request.Context(), c.Param("id"), c.GetString(gin.AuthUserKey))
+		if err != nil {
+			apiRunError(c, err)
+			return
+		}
+		c.JSON(200, run)
+	}
+}
+
+func handleV1RetryRun(c *gin.Context) {
+	if apiDraining(c) {
+		return
+	}
+	previous, err := runStore.Get(c.Param("id"))
+	if err != nil {
+		apiRunError(c, err)
+		return
+	}
+
+	plan, err := retryPlan(previous)
+	if err != nil {
+		apiRunError(c, err)
+		return
+	}
+	if len(plan.Items) == 0 {
+		apiFail(c, 422, codeNothingToDisburse,
+			fmt.Sprintf("Run %s has no failed disbursements that are safe to retry", previous.ID), nil)
+		return
+	}
+	run := newRun(plan, "api", c.GetString(gin.AuthUserKey))
+	run.RetryOf = previous.ID
+	if err := claimRetry(run); err != nil {
+		apiRunError(c, err)
+		return
+	}
+	executeRun(c.Request.Context(), run)
+	c.JSON(201, run)
+}
+
+// apiRunError maps an error from looking up or acting on a run: a missing
+// run is 404, a run in the wrong state or a stale plan is 409, an Airtable
+// failure is 502 and anything else, such as an unreadable run history, is
+// 500.
+func apiRunError(c *gin.Context, err error) {
+	var stateErr *runStateError
+	var changed *planChangedError
+	switch {
+	case errors.Is(err, errNotFound):
+		apiFail(c, 404, codeNotFound, err.Error(), nil)
+	case errors.As(err, &stateErr):
+		apiFail(c, 409, codeConflict, err.Error(), nil)
+	case errors.As(err, &changed):
+		apiFail(c, 409, codePlanChanged, err.Error(), changed.differences)
+	case errors.Is(err, errAirtable):
+		apiFail(c, 502, codeUpstream, err.Error(), nil)
+	default:
+		apiFail(c, 500, codeInternal, err.Error(), nil)
+	}
+}
+
+func handleV1ListDisbursements(c *gin.Context) {
+	filter, err := parseHistoryFilter(c.Query)
+	if err != nil {
+		apiFail(c, 400, codeInvalidRequest, err.Error(), nil)
+		return
+	}
+	page, perPage, err := parsePage(c.Query)
+	if err != nil {
+		apiFail(c, 400, codeInvalidRequest, err.Error(), nil)
+		return
+	}
+
+	entries, err := listDisbursements(filter)
+	if err != nil {
+		apiFail(c, 500, codeInternal, fmt.Sprintf("Failed to load runs: %v", err), nil)
+		return
+	}
+
+	items, pages := paginate(entries, page, perPage)
+	c.JSON(200, DisbursementPage{Disbursements: items, Page: page, PerPage: perPage, Pages: pages, Total: len(entries)})
+}
+
+func handleV1GetDisbursement(c *gin.Context) {
+	detail, err := disbursementDetail(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, errNotFound) {
+		apiFail(c, 404, codeNotFound, err.Error(), nil)
+		return
+	}
+	if errors.Is(err, errAirtable) {
+		apiFail(c, 502, codeUpstream, fmt.Sprintf("Failed to fetch the disbursement: %v", err), nil)
+		return
+	}
+	if err != nil {
+		apiFail(c, 500, codeInternal, fmt.Sprintf("Failed to load the run history: %v", err), nil)
+		return
+	}
+	c.JSON(200, detail)
+}
+
+func handleV1EventTimeline(c *gin.Context) {
+	hcbEventID := c.Param("hcb_event_id")
+	if !hcbEventIDPattern.MatchString(hcbEventID) {
+		apiFail(c, 400, codeInvalidRequest, fmt.Sprintf("%q is not an HCB organization", hcbEventID), nil)
+		return
+	}
+
+	timeline, err := eventTimeline(c.Request.Context(), hcbEventID)
+	if err != nil {
+		apiFail(c, 500, codeInternal, fmt.Sprintf("Failed to load the run history: %v", err), nil)
+		return
+	}
+	c.JSON(200, timeline)
+}
+
+func handleV1ListDeliveries(c *gin.Context) {
+	deliveries, err := deliveryStore.List()
+	if err != nil {
+		apiFail(c, 500, codeInternal, fmt.Sprintf("Failed to load webhook deliveries: %v", err), nil)
+		return
+	}
+
+	status := c.Query("status")
+	filtered := []WebhookDelivery{}
+	for _, delivery := range deliveries {
+		if status == "" || delivery.Status == status {
+			filtered = append(filtered, delivery)
+		}
+	}
+	c.JSON(200, DeliveryList{Deliveries: filtered})
+}
+
+func handleV1Redeliver(c *gin.Context) {
+	delivery, err := redeliverWebhook(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, errNotFound) {
+		apiFail(c, 404, codeNotFound, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		apiFail(c, 500, codeInternal, err.Error(), nil)
+		return
+	}
+	c.JSON(200, delivery)
+}
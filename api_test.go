@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAPIRunError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"missing run", fmt.Errorf("run x %w", errNotFound), 404, codeNotFound},
+		{"already approved", wrongStatus("x", "running", "awaiting_approval"), 409, codeConflict},
+		{"stale plan", fmt.Errorf("run x was not sent: %w", &planChangedError{}), 409, codePlanChanged},
+		{"airtable down", fmt.Errorf("run x was not sent: %w while checking the plan: timeout", errAirtable), 502, codeUpstream},
+		{"disk error", errors.New("read runs/x.json: input/output error"), 500, codeInternal},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			apiRunError(c, tt.err)
+
+			var body APIErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.status || body.Error.Code != tt.code {
+				t.Errorf("got %d %s, want %d %s", w.Code, body.Error.Code, tt.status, tt.code)
+			}
+		})
+	}
+}
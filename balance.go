@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// Autogrants pay the event's amount_owed, so the balance has to reflect a
+// disbursement before the next run or the same debt is paid twice. By default
+// amount_owed is left to Airtable; AMOUNT_OWED_WRITEBACK adds a step after the
+// disbursement's status update:
+//
+//	increment   add the amount to AMOUNT_DISBURSED_FIELD (default
+//	            amount_disbursed) on the event, which amount_owed subtracts
+//	verify      re-read the event and check amount_owed already dropped by
+//	            the amount, e.g. because it is a rollup of the disbursements
+//
+// Either way a failure fails the event without making it retryable, since
+// the money has already moved. Airtable has no transactions, so the increment
+// is a read followed by a write; runs are serialized, which keeps two of them
+// from interleaving.
+//
+// HCB can still reject a transfer after it was submitted. When the transfer
+// poll sees that, an increment is reversed: the amount is subtracted from
+// AMOUNT_DISBURSED_FIELD again, so the event is owed it once more. In verify
+// mode nothing was written, so nothing is reversed; amount_owed is whatever
+// Airtable computes, and the rejection alert asks to check that it counts
+// the event as owed again.
+const (
+	writebackOff       = "off"
+	writebackIncrement = "increment"
+	writebackVerify    = "verify"
+)
+
+const defaultAmountDisbursedField = "amount_disbursed"
+
+var errBalanceUnknown = errors.New("stopped while the event balance was being updated; check amount_owed on the event before the next run")
+
+func balanceWriteback() string {
+	if mode := os.Getenv("AMOUNT_OWED_WRITEBACK"); mode != "" {
+		return mode
+	}
+	return writebackOff
+}
+
+func amountDisbursedField() string {
+	if field := os.Getenv("AMOUNT_DISBURSED_FIELD"); field != "" {
+		return field
+	}
+	return defaultAmountDisbursedField
+}
+
+// recordEventBalance applies the configured write-back for a disbursement of
+// amount to event. event.Fields.AmountOwed is the balance the plan was made
+// from.
+func recordEventBalance(ctx context.Context, event AirtableEvent, amount float64) error {
+	switch balanceWriteback() {
+	case writebackIncrement:
+		return addAmountDisbursed(ctx, event.ID, amount)
+	case writebackVerify:
+		fields, err := getEventFields(ctx, event.ID)
+		if err != nil {
+			return fmt.Errorf("failed to read amount_owed: %v", err)
+		}
+		owed, _ := fields["amount_owed"].(float64)
+		expected := event.Fields.AmountOwed - amount
+		if math.Abs(owed-expected) > 0.005 {
+			return fmt.Errorf("amount_owed is %.2f, expected %.2f after this disbursement; "+
+				"check that it counts submitted and completed disbursements", owed, expected)
+		}
+	}
+	return nil
+}
+
+// addAmountDisbursed adds amount to the event's AMOUNT_DISBURSED_FIELD and
+// checks the write took.
+func addAmountDisbursed(ctx context.Context, recordID string, amount float64) error {
+	field := amountDisbursedField()
+	fields, err := getEventFields(ctx, recordID)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", field, err)
+	}
+	previous, _ := fields[field].(float64)
+	disbursed := math.Round((previous+amount)*100) / 100
+
+	fields, err = updateEventFields(ctx, recordID, map[string]interface{}{field: disbursed})
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %v", field, err)
+	}
+	if written, _ := fields[field].(float64); math.Abs(written-disbursed) > 0.005 {
+		return fmt.Errorf("%s is %.2f after writing %.2f", field, written, disbursed)
+	}
+	return nil
+}
+
+func getEventFields(ctx context.Context, recordID string) (map[string]interface{}, error) {
+	return eventRecordRequest(ctx, "GET", recordID, nil)
+}
+
+func updateEventFields(ctx context.Context, recordID string, fields map[string]interface{}) (map[string]interface{}, error) {
+	jsonData, err := json.Marshal(map[string]interface{}{"fields": fields})
+	if err != nil {
+		return nil, err
+	}
+	return eventRecordRequest(ctx, "PATCH", recordID, jsonData)
+}
+
+func eventRecordRequest(ctx context.Context, method, recordID string, payload []byte) (map[string]interface{}, error) {
+	u := fmt.Sprintf("https://api.airtable.com/v0/%s/events/%s", os.Getenv("AIRTABLE_BASE_ID"), url.PathEscape(recordID))
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("AIRTABLE_API_KEY"))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := airtableClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("airtable API error: %s", string(body))
+	}
+
+	var record struct {
+		Fields map[string]interface{} `json:"fields"`
+	}
+	if err := json.Unmarshal(body, &record); err != nil {
+		return nil, err
+	}
+	return record.Fields, nil
+}
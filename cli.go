@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const cliUsage = `Usage: cash-cannon <command> [flags]
+
+Commands:
+  serve                          Start the dashboard (default)
+  preview [--custom-amount N]    Show what a run would send
+  preview --upload FILE          Check and show a per-event amounts file
+  run autogrant                  Disburse amount_owed to every event
+  run custom --amount N          Send a flat amount to every event (--clawback pulls it back)
+                                 (narrow with --view, --formula or --records)
+  run upload FILE                Send the per-event amounts in a CSV or JSON file
+  retry <run-id>                 Re-send the failed disbursements of a run
+  reconcile                      List disbursements stuck in pending
+  transfers poll                 Check HCB for the status of submitted transfers
+  export [--run ID] [--from D]   Export disbursements as csv, json or journal (--format)
+  runs list                      Show the run history
+  runs approve <run-id>          Send a scheduled plan awaiting approval
+  runs reject <run-id>           Discard a scheduled plan awaiting approval
+  runs resume <run-id>           Continue a run interrupted by shutdown
+  webhook-sink [--addr :9999]    Print webhook payloads posted to it (local testing)
+
+Run commands accept --dry-run, --yes and --operator. Runs that claw money
+back also need --confirm-clawback, even with --yes. Flags that do not apply
+to the chosen mode are refused.
+Every command but export accepts --output table|json.
+`
+
+// runCLI executes a headless command and returns the process exit code.
+// Runs go through the same engine as the dashboard and land in the same
+// run history.
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+
+	ctx := context.Background()
+	var err error
+	switch args[0] {
+	case "preview":
+		err = cliPreview(ctx, args[1:], stdout)
+	case "run":
+		if len(args) < 2 || (args[1] != "autogrant" && args[1] != "custom" && args[1] != "upload") {
+			fmt.Fprint(stderr, cliUsage)
+			return 2
+		}
+		return cliRun(ctx, args[1], args[2:], stdin, stdout, stderr)
+	case "retry":
+		return cliRetry(ctx, args[1:], stdin, stdout, stderr)
+	case "reconcile":
+		err = cliReconcile(ctx, args[1:], stdout)
+	case "export":
+		err = cliExport(args[1:], stdout)
+	case "transfers":
+		if len(args) < 2 || args[1] != "poll" {
+			fmt.Fprint(stderr, cliUsage)
+			return 2
+		}
+		err = cliTransfersPoll(ctx, args[2:], stdout)
+	case "runs":
+		if len(args) < 2 {
+			fmt.Fprint(stderr, cliUsage)
+			return 2
+		}
+		switch args[1] {
+		case "list":
+			err = cliRunsList(args[2:], stdout)
+		case "approve", "reject", "resume":
+			return cliDecideRun(ctx, args[1], args[2:], stdout, stderr)
+		default:
+			fmt.Fprint(stderr, cliUsage)
+			return 2
+		}
+	case "webhook-sink":
+		err = cliWebhookSink(args[1:], stdout)
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, cliUsage)
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], cliUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		var usage usageError
+		if errors.As(err, &usage) {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+// usageError is a mistake on the command line rather than a failure; the
+// command exits with status 2.
+type usageError struct {
+	error
+}
+
+// rejectFlags fails if any of the named flags was given, so a flag that does
+// nothing in the chosen mode is never mistaken for one that narrows the run.
+func rejectFlags(fs *flag.FlagSet, mode string, names ...string) error {
+	var given []string
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range names {
+			if f.Name == name {
+				given = append(given, "--"+name)
+			}
+		}
+	})
+	if len(given) > 0 {
+		return fmt.Errorf("%s cannot be used with %s", strings.Join(given, ", "), mode)
+	}
+	return nil
+}
+
+// runFlags are shared by every command that can send money.
+type runFlags struct {
+	dryRun          bool
+	yes             bool
+	confirmClawback bool
+	operator        string
+	output          string
+}
+
+func (f *runFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.dryRun, "dry-run", false, "show the plan without sending anything")
+	fs.BoolVar(&f.yes, "yes", false, "skip the confirmation prompt")
+	fs.BoolVar(&f.confirmClawback, "confirm-clawback", false, "allow a run that claws money back from events")
+	fs.StringVar(&f.operator, "operator", os.Getenv("USER"), "operator recorded in the run history")
+	fs.StringVar(&f.output, "output", "table", "output format: table or json")
+}
+
+// targetFlags narrow the events of a custom run.
+type targetFlags struct {
+	view    string
+	formula string
+	records string
+}
+
+func (f *targetFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.view, "view", "", "custom runs: events view ID to use instead of the default view")
+	fs.StringVar(&f.formula, "formula", "", "custom runs: Airtable formula selecting events within the view")
+	fs.StringVar(&f.records, "records", "", "custom runs: comma-separated record IDs to send to")
+}
+
+func (f *targetFlags) target() (EventTarget, error) {
+	values := map[string]string{"view": f.view, "formula": f.formula, "record_ids": f.records}
+	return parseEventTarget(func(key string) string { return values[key] })
+}
+
+// parseArgs parses flags that may appear before or after positional
+// arguments and returns the positional ones.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func cliPreview(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("preview", flag.ContinueOnError)
+	customAmount := fs.Float64("custom-amount", 0, "preview a custom disbursement of this amount per event")
+	upload := fs.String("upload", "", "preview a CSV or JSON file of per-event amounts")
+	memo := fs.String("memo", "", "memo for custom and upload previews")
+	output := fs.String("output", "table", "output format: table or json")
+	var targeting targetFlags
+	targeting.register(fs)
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	if !finite(*customAmount) {
+		return fmt.Errorf("--custom-amount must be a finite number")
+	}
+	switch {
+	case *upload != "":
+		if err := rejectFlags(fs, "preview --upload", "custom-amount", "view", "formula", "records"); err != nil {
+			return usageError{err}
+		}
+	case *customAmount == 0:
+		if err := rejectFlags(fs, "an autogrant preview", "view", "formula", "records", "memo"); err != nil {
+			return usageError{err}
+		}
+	}
+
+	target := EventTarget{}
+	if *customAmount != 0 {
+		var err error
+		if target, err = targeting.target(); err != nil {
+			return err
+		}
+	}
+
+	events, err := getAllEvents(ctx, target)
+	if err != nil {
+		return fmt.Errorf("failed to fetch events: %v", err)
+	}
+
+	plan := buildAutograntPlan(ctx, events)
+	if *customAmount != 0 {
+		plan = buildCustomPlan(ctx, events, *customAmount, target)
+	}
+	if *upload != "" {
+		if plan, err = readUploadFile(ctx, *upload, events); err != nil {
+			return err
+		}
+	}
+	if plan.Mode == "custom" {
+		plan.setMemo(strings.TrimSpace(*memo))
+	}
+	return printPlan(stdout, plan, *output)
+}
+
+// readUploadFile builds a plan from a per-event amounts file, reporting every
+// problem in it at once.
+func readUploadFile(ctx context.Context, path string, events []AirtableEvent) (Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Plan{}, err
+	}
+	rows, err := parseUpload(path, data)
+	if err != nil {
+		return Plan{}, err
+	}
+	plan, problems := buildUploadPlan(ctx, events, rows, filepath.Base(path))
+	if len(problems) > 0 {
+		return Plan{}, fmt.Errorf("%d problems in %s:\n  %s", len(problems), path, strings.Join(problems, "\n  "))
+	}
+	return plan, nil
+}
+
+func cliRun(ctx context.Context, mode string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("run "+mode, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var flags runFlags
+	flags.register(fs)
+	amount := fs.Float64("amount", 0, "amount per event for custom runs; negative claws back")
+	clawback := fs.Bool("clawback", false, "custom runs: pull --amount back from each event instead of sending it")
+	memo := fs.String("memo", "", "custom and upload runs: memo for the transfer names and notes")
+	var targeting targetFlags
+	targeting.register(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+
+	target := EventTarget{}
+	if mode == "custom" {
+		if target, err = targeting.target(); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 2
+		}
+	}
+	if !finite(*amount) {
+		fmt.Fprintln(stderr, "Error: --amount must be a finite number")
+		return 2
+	}
+	if mode == "custom" && *amount == 0 {
+		fmt.Fprintln(stderr, "Error: run custom requires a non-zero --amount")
+		return 2
+	}
+	if *clawback {
+		*amount = -math.Abs(*amount)
+	}
+	if mode == "upload" && len(positional) != 1 {
+		fmt.Fprintln(stderr, "Error: run upload requires exactly one file")
+		return 2
+	}
+	switch mode {
+	case "autogrant":
+		err = rejectFlags(fs, "run autogrant", "amount", "clawback", "confirm-clawback", "memo", "view", "formula", "records")
+	case "upload":
+		// Upload rows carry their own amounts, negative to claw back, so only
+		// --confirm-clawback applies
+		err = rejectFlags(fs, "run upload", "amount", "clawback", "view", "formula", "records")
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 2
+	}
+	ctx = withLogAttrs(ctx, "user", flags.operator)
+
+	events, err := getAllEvents(ctx, target)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: failed to fetch events: %v\n", err)
+		return 1
+	}
+
+	plan := buildAutograntPlan(ctx, events)
+	switch mode {
+	case "custom":
+		plan = buildCustomPlan(ctx, events, *amount, target)
+	case "upload":
+		if plan, err = readUploadFile(ctx, positional[0], events); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	plan.setMemo(strings.TrimSpace(*memo))
+	return executeFromCLI(ctx, newRun(plan, "cli", flags.operator), flags, stdin, stdout, stderr)
+}
+
+func cliRetry(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("retry", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var flags runFlags
+	flags.register(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(stderr, "Error: retry requires exactly one run ID")
+		return 2
+	}
+
+	previous, err := runStore.Get(positional[0])
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	plan, err := retryPlan(previous)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	run := newRun(plan, "cli", flags.operator)
+	run.RetryOf = previous.ID
+	return executeFromCLI(withLogAttrs(ctx, "user", flags.operator), run, flags, stdin, stdout, stderr)
+}
+
+// executeFromCLI shows the plan on stderr, asks for confirmation unless --yes
+// was given, and runs it. A plan with clawbacks is refused without
+// --confirm-clawback, so --yes alone never pulls money back.
+func executeFromCLI(ctx context.Context, run *Run, flags runFlags, stdin io.Reader, stdout, stderr io.Writer) int {
+	if flags.dryRun {
+		if err := printPlan(stdout, run.Plan, flags.output); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if len(run.Plan.Items) == 0 {
+		fmt.Fprintln(stderr, "Nothing to disburse.")
+		return 0
+	}
+	if count, total := run.Plan.clawbacks(); count > 0 && !flags.confirmClawback {
+		fmt.Fprintf(stderr, "Error: this run claws back $%.2f from %d events; pass --confirm-clawback to send it\n", total, count)
+		return 1
+	}
+	if runLockHeld() {
+		fmt.Fprintln(stderr, "Error: another run is executing (is the server sending one?); try again once it finishes")
+		return 1
+	}
+	if !flags.yes {
+		printPlan(stderr, run.Plan, "table")
+		if !confirm(stdin, stderr, run.Plan) || isDraining() {
+			fmt.Fprintln(stderr, "Aborted.")
+			return 1
+		}
+	}
+
+	if run.RetryOf != "" {
+		if err := claimRetry(run); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	executeRun(ctx, run)
+
+	if err := printRun(stdout, run, flags.output); err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	return runExitCode(run, stderr)
+}
+
+// runExitCode is non-zero when any disbursement failed or the run was
+// interrupted, so cron and scripts notice.
+func runExitCode(run *Run, stderr io.Writer) int {
+	if run.Status == "interrupted" {
+		fmt.Fprintf(stderr, "Run interrupted; resume with: cash-cannon runs resume %s\n", run.ID)
+		return 1
+	}
+	if run.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// confirm asks for "yes", or for "clawback" when the plan pulls money back
+// from events.
+func confirm(stdin io.Reader, stderr io.Writer, plan Plan) bool {
+	expected := "yes"
+	if count, total := plan.clawbacks(); count > 0 {
+		fmt.Fprintf(stderr, "This run claws back $%.2f from %d events.\n", total, count)
+		expected = "clawback"
+	}
+	fmt.Fprintf(stderr, "Send %d %s disbursements totalling $%.2f? Type '%s' to continue: ",
+		len(plan.Items), plan.Mode, plan.TotalAmount, expected)
+	answer, _ := bufio.NewReader(stdin).ReadString('\n')
+	return strings.TrimSpace(answer) == expected
+}
+
+func cliReconcile(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	output := fs.String("output", "table", "output format: table or json")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	pending, err := getDisbursementsByStatus(ctx, "pending")
+	if err != nil {
+		return fmt.Errorf("failed to fetch pending disbursements: %v", err)
+	}
+	runs, err := runStore.List()
+	if err != nil {
+		return err
+	}
+
+	runByRecord := map[string]string{}
+	for _, run := range runs {
+		for _, result := range run.Results {
+			if result.DisbursementRecordID != "" {
+				runByRecord[result.DisbursementRecordID] = run.ID
+			}
+		}
+	}
+
+	type pendingDisbursement struct {
+		RecordID       string  `json:"record_id"`
+		DisbursementID int     `json:"disbursement_id"`
+		Event          string  `json:"associated_event"`
+		Amount         float64 `json:"amount"`
+		Type           string  `json:"disbursement_type"`
+		RunID          string  `json:"run_id,omitempty"`
+	}
+	var report []pendingDisbursement
+	for _, d := range pending {
+		report = append(report, pendingDisbursement{
+			RecordID:       d.ID,
+			DisbursementID: d.Fields.DisbursementID,
+			Event:          strings.Join(d.Fields.AssociatedEvent, ","),
+			Amount:         d.Fields.Amount,
+			Type:           d.Fields.DisbursementType,
+			RunID:          runByRecord[d.ID],
+		})
+	}
+
+	if *output == "json" {
+		return printJSON(stdout, report)
+	}
+	if len(report) == 0 {
+		fmt.Fprintln(stdout, "No pending disbursements.")
+		return nil
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RECORD\tID\tEVENT\tAMOUNT\tTYPE\tRUN")
+	for _, p := range report {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%.2f\t%s\t%s\n", p.RecordID, p.DisbursementID, p.Event, p.Amount, p.Type, p.RunID)
+	}
+	return w.Flush()
+}
+
+func cliTransfersPoll(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("transfers poll", flag.ContinueOnError)
+	output := fs.String("output", "table", "output format: table or json")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	result, err := pollTransfers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		return printJSON(stdout, result)
+	}
+	fmt.Fprintf(stdout, "Checked %d submitted transfers, %d changed.\n", result.Checked, len(result.Transitions))
+	if len(result.Transitions) > 0 {
+		w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "RECORD\tID\tHCB TRANSFER\tHCB STATUS\tFROM\tTO")
+		for _, t := range result.Transitions {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", t.RecordID, t.DisbursementID, t.HCBTransferID, t.HCBStatus, t.From, t.To)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	for _, e := range result.Errors {
+		fmt.Fprintf(stdout, "Error: %s\n", e)
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("%d transfers could not be checked", len(result.Errors))
+	}
+	return nil
+}
+
+func cliExport(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "csv", "export format: "+strings.Join(exportFormats, ", "))
+	run := fs.String("run", "", "export only this run")
+	from := fs.String("from", "", "first day to export (YYYY-MM-DD)")
+	to := fs.String("to", "", "last day to export (YYYY-MM-DD)")
+	out := fs.String("out", "", "write to this file instead of stdout")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if !validExportFormat(*format) {
+		return fmt.Errorf("--format must be one of %s", strings.Join(exportFormats, ", "))
+	}
+
+	filter, err := parseHistoryFilter(func(name string) string {
+		return map[string]string{"run": *run, "from": *from, "to": *to}[name]
+	})
+	if err != nil {
+		return err
+	}
+	entries, err := listDisbursements(filter)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		return writeExport(stdout, *format, entries)
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := writeExport(file, *format, entries); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func cliRunsList(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("runs list", flag.ContinueOnError)
+	limit := fs.Int("limit", 20, "maximum number of runs to show")
+	output := fs.String("output", "table", "output format: table or json")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	runs, err := runStore.List()
+	if err != nil {
+		return err
+	}
+	if *limit > 0 && len(runs) > *limit {
+		runs = runs[:*limit]
+	}
+
+	if *output == "json" {
+		return printJSON(stdout, runs)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tMODE\tSOURCE\tOPERATOR\tSTATUS\tPLANNED\tCREATED\tPROCESSED\tFAILED")
+	for _, run := range runs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n", run.ID, run.Mode, run.Source, run.Operator,
+			run.Status, run.CreatedAt.Format(time.RFC3339), run.Created, run.Processed, run.Failed)
+	}
+	return w.Flush()
+}
+
+func cliDecideRun(ctx context.Context, decision string, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("runs "+decision, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	operator := fs.String("operator", os.Getenv("USER"), "operator recorded in the run history")
+	output := fs.String("output", "table", "output format: table or json")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 {
+		fmt.Fprintf(stderr, "Error: runs %s requires exactly one run ID\n", decision)
+		return 2
+	}
+
+	ctx = withLogAttrs(ctx, "user", *operator)
+	var run *Run
+	switch decision {
+	case "approve":
+		run, err = approveRun(ctx, positional[0], *operator)
+	case "resume":
+		run, err = resumeRun(ctx, positional[0], *operator)
+	default:
+		run, err = rejectRun(ctx, positional[0], *operator)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	if err := printRun(stdout, run, *output); err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	return runExitCode(run, stderr)
+}
+
+// cliWebhookSink stands in for Slack and other webhook receivers during local
+// testing: it accepts any POST and prints the headers that matter and the body.
+func cliWebhookSink(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("webhook-sink", flag.ContinueOnError)
+	addr := fs.String("addr", ":9999", "address to listen on")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Listening for webhooks on %s\n", *addr)
+	return http.ListenAndServe(*addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(stdout, "--- %s %s %s\n", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+		for name, values := range r.Header {
+			if strings.HasPrefix(name, "X-") {
+				fmt.Fprintf(stdout, "%s: %s\n", name, strings.Join(values, ", "))
+			}
+		}
+		fmt.Fprintf(stdout, "%s\n", body)
+		w.Write([]byte("ok"))
+	}))
+}
+
+func printPlan(stdout io.Writer, plan Plan, output string) error {
+	if output == "json" {
+		return printJSON(stdout, plan)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RECORD\tHCB EVENT ID\tORGANIZATION\tAMOUNT\tDIRECTION\tMEMO\tWARNINGS")
+	for _, item := range plan.Items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.2f\t%s\t%s\t%s\n", item.RecordID, item.HCBEventID, plan.Organizations[item.HCBEventID],
+			item.Amount, item.Direction, item.Memo, strings.Join(plan.warnings(item.RecordID), "; "))
+	}
+	fmt.Fprintf(w, "\n%d of %d events, total $%.2f\n", plan.EventCount, plan.TotalEvents, plan.TotalAmount)
+	for _, exclusion := range plan.Exclusions {
+		if exclusion.ExcludedBy == excludedByValidation {
+			fmt.Fprintf(w, "Not sent %s (%q, %.2f): %s\n", exclusion.RecordID, exclusion.HCBEventID, exclusion.Amount, exclusion.Reason)
+		}
+	}
+	return w.Flush()
+}
+
+func printRun(stdout io.Writer, run *Run, output string) error {
+	if output == "json" {
+		return printJSON(stdout, run)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RECORD\tHCB EVENT ID\tAMOUNT\tDISBURSEMENT\tHCB TRANSFER\tSTATUS\tERROR")
+	for _, result := range run.Results {
+		fmt.Fprintf(w, "%s\t%s\t%.2f\t%d\t%s\t%s\t%s\n", result.RecordID, result.HCBEventID, result.Amount,
+			result.DisbursementID, result.HCBTransferID, result.Status, result.Error)
+	}
+	fmt.Fprintf(w, "\nRun %s: created %d, processed %d, failed %d\n", run.ID, run.Created, run.Processed, run.Failed)
+	for _, exclusion := range run.Plan.Exclusions {
+		by := exclusion.ExcludedBy
+		if by == excludedByValidation {
+			by = ""
+		}
+		fmt.Fprintf(w, "Excluded %s (%s): %s%s\n", exclusion.RecordID, exclusion.HCBEventID,
+			exclusion.Reason, operatorSuffix(by))
+	}
+	return w.Flush()
+}
+
+func printJSON(stdout io.Writer, v interface{}) error {
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCLIRejectsFlagsForOtherModes(t *testing.T) {
+	tests := [][]string{
+		{"run", "autogrant", "--records", "recEvent0000001"},
+		{"run", "autogrant", "--view", "viwOther", "--yes"},
+		{"run", "autogrant", "--formula", "{region}='EU'"},
+		{"run", "autogrant", "--amount", "5"},
+		{"run", "autogrant", "--confirm-clawback"},
+		{"run", "upload", "rows.csv", "--clawback"},
+		{"run", "upload", "rows.csv", "--records", "recEvent0000001"},
+		{"preview", "--upload", "rows.csv", "--custom-amount", "5"},
+		{"preview", "--records", "recEvent0000001"},
+	}
+	for _, args := range tests {
+		var stderr strings.Builder
+		if code := runCLI(args, strings.NewReader(""), io.Discard, &stderr); code != 2 {
+			t.Errorf("%q exited %d, want 2 (%s)", args, code, stderr.String())
+		}
+		if !strings.Contains(stderr.String(), "cannot be used with") {
+			t.Errorf("%q: stderr = %q, want the rejected flags", args, stderr.String())
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// requiredSettings lists the variables the command in args cannot run
+// without. Commands that only read local state need no credentials.
+func requiredSettings(args []string) []string {
+	upstream := []string{"AIRTABLE_API_KEY", "AIRTABLE_BASE_ID", "HCB_API_TOKEN"}
+	if len(args) == 0 || args[0] == "serve" {
+		return append(upstream, "BASIC_AUTH_USERNAME", "BASIC_AUTH_PASSWORD")
+	}
+	switch args[0] {
+	case "webhook-sink", "export", "help", "-h", "--help":
+		return nil
+	case "runs":
+		if len(args) > 1 && (args[1] == "list" || args[1] == "reject") {
+			return nil
+		}
+	}
+	return upstream
+}
+
+// validateConfig checks the environment before anything starts, returning
+// every problem at once rather than stopping at the first.
+func validateConfig(required []string) []error {
+	var errs []error
+
+	for _, name := range required {
+		if os.Getenv(name) == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+
+	if port := os.Getenv("PORT"); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			errs = append(errs, fmt.Errorf("PORT %q is not a valid port", port))
+		}
+	}
+
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			errs = append(errs, fmt.Errorf("LOG_LEVEL %q must be debug, info, warn or error", level))
+		}
+	}
+
+	if spec := os.Getenv("AUTOGRANT_SCHEDULE"); spec != "" {
+		if _, err := cron.ParseStandard(spec); err != nil {
+			errs = append(errs, fmt.Errorf("AUTOGRANT_SCHEDULE %q: %v", spec, err))
+		}
+	}
+	if spec := transferPollSchedule(); spec != "" {
+		if _, err := cron.ParseStandard(spec); err != nil {
+			errs = append(errs, fmt.Errorf("TRANSFER_POLL_SCHEDULE %q: %v", spec, err))
+		}
+	}
+	for _, name := range []string{"AUTOGRANT_MAX_TOTAL", "AUTOGRANT_MAX_PER_EVENT", "EVENT_WARN_AMOUNT", "EVENT_BLOCK_AMOUNT"} {
+		if value := os.Getenv(name); value != "" {
+			if n, err := parseAmount(value); err != nil || n < 0 {
+				errs = append(errs, fmt.Errorf("%s %q must be a non-negative number", name, value))
+			}
+		}
+	}
+
+	switch mode := balanceWriteback(); mode {
+	case writebackOff, writebackIncrement, writebackVerify:
+	default:
+		errs = append(errs, fmt.Errorf("AMOUNT_OWED_WRITEBACK %q must be off, increment or verify", mode))
+	}
+
+	if u := os.Getenv("SLACK_WEBHOOK_URL"); u != "" && !validHTTPURL(u) {
+		errs = append(errs, errors.New("SLACK_WEBHOOK_URL is not a valid http(s) URL"))
+	}
+	for _, u := range webhookURLs() {
+		if !validHTTPURL(u) {
+			errs = append(errs, fmt.Errorf("WEBHOOK_URLS entry %q is not a valid http(s) URL", u))
+		}
+	}
+	if len(webhookURLs()) > 0 && os.Getenv("WEBHOOK_SECRET") == "" {
+		errs = append(errs, errors.New("WEBHOOK_SECRET is required when WEBHOOK_URLS is set"))
+	}
+
+	errs = append(errs, checkTransferTemplates()...)
+
+	return errs
+}
+
+func validHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// readinessCacheTTL keeps frequent probes from spending the Airtable rate
+// limit.
+const readinessCacheTTL = 30 * time.Second
+
+type readinessCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+var readiness struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	checks    map[string]readinessCheck
+}
+
+// checkReadiness verifies the Airtable and HCB credentials with one small
+// request each, reusing the previous answer for readinessCacheTTL.
+func checkReadiness(ctx context.Context) (bool, map[string]readinessCheck) {
+	readiness.mu.Lock()
+	defer readiness.mu.Unlock()
+
+	if time.Since(readiness.checkedAt) > readinessCacheTTL {
+		readiness.checks = map[string]readinessCheck{
+			"airtable": toReadinessCheck(checkAirtable(ctx)),
+			"hcb":      toReadinessCheck(checkHCB(ctx)),
+		}
+		readiness.checkedAt = time.Now()
+	}
+
+	ready := true
+	for _, check := range readiness.checks {
+		ready = ready && check.OK
+	}
+	return ready, readiness.checks
+}
+
+func toReadinessCheck(err error) readinessCheck {
+	if err != nil {
+		return readinessCheck{Error: err.Error()}
+	}
+	return readinessCheck{OK: true}
+}
+
+func checkAirtable(ctx context.Context) error {
+	u := fmt.Sprintf("https://api.airtable.com/v0/%s/events?view=%s&maxRecords=1&pageSize=1", os.Getenv("AIRTABLE_BASE_ID"), eventsViewID)
+	return checkUpstream(ctx, airtableClient, u, "Bearer "+os.Getenv("AIRTABLE_API_KEY"))
+}
+
+func checkHCB(ctx context.Context) error {
+	return checkUpstream(ctx, hcbClient, "https://hcb.hackclub.com/api/v4/user", "Bearer "+os.Getenv("HCB_API_TOKEN"))
+}
+
+func checkUpstream(ctx context.Context, client *http.Client, u, authorization string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
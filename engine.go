@@ -0,0 +1,628 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Plan is the list of disbursements a run is going to make. It is built from
+// the events view before any money moves, so the dashboard preview and the
+// CLI both show exactly what executeRun will send.
+type Plan struct {
+	Mode         string       `json:"mode"`
+	CustomAmount float64      `json:"custom_amount,omitempty"`
+	Upload       string       `json:"upload,omitempty"`
+	Memo         string       `json:"memo,omitempty"`
+	Target       *EventTarget `json:"target,omitempty"`
+	TotalEvents  int          `json:"total_events"`
+	TotalAmount  float64      `json:"total_amount"`
+	EventCount   int          `json:"event_count"`
+	Items        []PlanItem   `json:"events"`
+
+	Exclusions []Exclusion  `json:"exclusions,omitempty"`
+	Checks     []EventCheck `json:"checks,omitempty"`
+
+	// Organizations maps each hcb_event_id to its HCB display name.
+	Organizations map[string]string `json:"organizations,omitempty"`
+}
+
+type PlanItem struct {
+	RecordID   string  `json:"record_id"`
+	HCBEventID string  `json:"hcb_event_id"`
+	Amount     float64 `json:"amount"`
+	Direction  string  `json:"direction"`
+	Memo       string  `json:"memo,omitempty"`
+}
+
+// Exclusion is an event the operator left out of a plan, with their reason.
+type Exclusion struct {
+	PlanItem
+	Reason     string `json:"reason"`
+	ExcludedBy string `json:"excluded_by,omitempty"`
+}
+
+// event rebuilds the Airtable event the disbursement functions expect.
+func (item PlanItem) event() AirtableEvent {
+	var event AirtableEvent
+	event.ID = item.RecordID
+	event.Fields.HCBEventID = item.HCBEventID
+	event.Fields.AmountOwed = item.Amount
+	return event
+}
+
+func buildAutograntPlan(ctx context.Context, events []AirtableEvent) Plan {
+	plan := Plan{Mode: "autogrant", TotalEvents: len(events)}
+	for _, event := range events {
+		if event.Fields.AmountOwed != 0 { // Process both positive and negative amounts
+			direction := "grant"
+			if event.Fields.AmountOwed < 0 {
+				direction = "withdrawal"
+			}
+			plan.Items = append(plan.Items, PlanItem{
+				RecordID:   event.ID,
+				HCBEventID: event.Fields.HCBEventID,
+				Amount:     event.Fields.AmountOwed,
+				Direction:  direction,
+			})
+			plan.TotalAmount += event.Fields.AmountOwed
+		}
+	}
+	plan.EventCount = len(plan.Items)
+	plan.validate(ctx, events)
+	return plan
+}
+
+// buildCustomPlan sends customAmount to every event the target selected. A
+// non-default target is kept on the plan for the run history.
+func buildCustomPlan(ctx context.Context, events []AirtableEvent, customAmount float64, target EventTarget) Plan {
+	plan := Plan{Mode: "custom", CustomAmount: customAmount, TotalEvents: len(events)}
+	if !target.isDefault() {
+		plan.Target = &target
+	}
+	for _, event := range events {
+		plan.Items = append(plan.Items, PlanItem{
+			RecordID:   event.ID,
+			HCBEventID: event.Fields.HCBEventID,
+			Amount:     customAmount,
+			Direction:  directionFor(customAmount),
+		})
+		plan.TotalAmount += customAmount
+	}
+	plan.EventCount = len(plan.Items)
+	plan.validate(ctx, events)
+	return plan
+}
+
+// excludeEvents drops the events in reasons, keyed by record ID, from the
+// plan. They are kept in Exclusions so the run history shows what was left
+// out and why.
+func (plan *Plan) excludeEvents(reasons map[string]string, operator string) {
+	var items []PlanItem
+	plan.TotalAmount = 0
+	for _, item := range plan.Items {
+		if reason, ok := reasons[item.RecordID]; ok {
+			plan.Exclusions = append(plan.Exclusions, Exclusion{PlanItem: item, Reason: reason, ExcludedBy: operator})
+			continue
+		}
+		items = append(items, item)
+		plan.TotalAmount += item.Amount
+	}
+	plan.Items = items
+	plan.EventCount = len(items)
+}
+
+// ExpectedItem is an event the operator saw in the preview and left ticked,
+// with the amount shown for it.
+type ExpectedItem struct {
+	RecordID string  `json:"record_id"`
+	Amount   float64 `json:"amount"`
+}
+
+// PlanDifference is an event whose amount in the rebuilt plan differs from
+// the preview. Expected or Planned is nil when the event is missing on that
+// side.
+type PlanDifference struct {
+	RecordID string   `json:"record_id"`
+	Expected *float64 `json:"expected,omitempty"`
+	Planned  *float64 `json:"planned,omitempty"`
+}
+
+// differences compares the plan, rebuilt from live data when a run is
+// executed, with the events the operator confirmed. Any difference means
+// balances or the events view changed since the preview, so the run must
+// not be sent.
+func (plan Plan) differences(expected []ExpectedItem) []PlanDifference {
+	want := make(map[string]float64)
+	for _, item := range expected {
+		want[item.RecordID] += item.Amount
+	}
+	planned := make(map[string]float64)
+	for _, item := range plan.Items {
+		planned[item.RecordID] += item.Amount
+	}
+
+	var diffs []PlanDifference
+	for _, item := range plan.Items {
+		amount := planned[item.RecordID]
+		expectedAmount, ok := want[item.RecordID]
+		switch {
+		case !ok:
+			diffs = append(diffs, PlanDifference{RecordID: item.RecordID, Planned: &amount})
+		case math.Abs(expectedAmount-amount) > 0.005:
+			diffs = append(diffs, PlanDifference{RecordID: item.RecordID, Expected: &expectedAmount, Planned: &amount})
+		}
+		delete(want, item.RecordID)
+		delete(planned, item.RecordID)
+	}
+	for _, item := range expected {
+		if amount, ok := want[item.RecordID]; ok {
+			diffs = append(diffs, PlanDifference{RecordID: item.RecordID, Expected: &amount})
+			delete(want, item.RecordID)
+		}
+	}
+	return diffs
+}
+
+// expected lists the plan's events the way differences takes them.
+func (plan Plan) expected() []ExpectedItem {
+	expected := make([]ExpectedItem, len(plan.Items))
+	for i, item := range plan.Items {
+		expected[i] = ExpectedItem{RecordID: item.RecordID, Amount: item.Amount}
+	}
+	return expected
+}
+
+// planChangedError is returned by startRun when the plan, rebuilt once the
+// run lock is held, no longer matches the run's.
+type planChangedError struct {
+	differences []PlanDifference
+}
+
+func (err *planChangedError) Error() string {
+	return fmt.Sprintf("%d events changed since the plan was made", len(err.differences))
+}
+
+func directionFor(amount float64) string {
+	if amount < 0 {
+		return "withdrawal"
+	}
+	return "grant"
+}
+
+// clawbacks totals the custom withdrawals in the plan, which need an extra
+// confirmation before they are sent.
+func (plan Plan) clawbacks() (count int, total float64) {
+	if plan.Mode != "custom" {
+		return 0, 0
+	}
+	for _, item := range plan.Items {
+		if item.Amount < 0 {
+			count++
+			total -= item.Amount
+		}
+	}
+	return count, total
+}
+
+// setMemo records the operator's memo for the run and applies it to every
+// event that has no memo of its own.
+func (plan *Plan) setMemo(memo string) {
+	plan.Memo = memo
+	for i := range plan.Items {
+		if plan.Items[i].Memo == "" {
+			plan.Items[i].Memo = memo
+		}
+	}
+}
+
+// disbursementTypeFor matches the disbursement_type written to Airtable.
+func disbursementTypeFor(mode string, amount float64) string {
+	if mode == "custom" {
+		if amount < 0 {
+			return "clawback"
+		}
+		return "miscellaneous"
+	}
+	if amount < 0 {
+		return "withdrawal"
+	}
+	return "autogrant"
+}
+
+// Run is one execution of a plan, kept in the run history.
+type Run struct {
+	ID         string      `json:"id"`
+	Mode       string      `json:"mode"`
+	Source     string      `json:"source"`
+	Operator   string      `json:"operator,omitempty"`
+	RetryOf    string      `json:"retry_of,omitempty"`
+	ApprovedBy string      `json:"approved_by,omitempty"`
+	Status     string      `json:"status"`
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	Plan       Plan        `json:"plan"`
+	Results    []RunResult `json:"results"`
+	Created    int         `json:"created"`
+	Processed  int         `json:"processed"`
+	Failed     int         `json:"failed"`
+
+	PolicyViolations []string `json:"policy_violations,omitempty"`
+}
+
+// RunResult is one event of a run. Status is empty while the event is in
+// progress; Step is its checkpoint and is saved before each call that follows
+// it, so a resumed run knows exactly which calls already happened.
+type RunResult struct {
+	PlanItem
+	DisbursementRecordID string `json:"disbursement_record_id,omitempty"`
+	DisbursementID       int    `json:"disbursement_id,omitempty"`
+	HCBTransferID        string `json:"hcb_transfer_id,omitempty"`
+	HCBTransferStatus    string `json:"hcb_transfer_status,omitempty"`
+	Step                 string `json:"step,omitempty"`
+	Status               string `json:"status"`
+	Error                string `json:"error,omitempty"`
+	BalanceWriteback     string `json:"balance_writeback,omitempty"`
+	BalanceReversed      bool   `json:"balance_reversed,omitempty"`
+	RetriedBy            string `json:"retried_by,omitempty"`
+}
+
+// Checkpoint steps, in order. transfer_started is saved before the HCB
+// request goes out: an event left at that step was stopped mid-request, or
+// the request failed without a definite answer from HCB (a network error, a
+// timeout, a 5xx response or an unreadable response), so its transfer may
+// or may not exist and it is never sent again. Only an error response from
+// HCB itself moves the event to transfer_failed, which may be retried. The
+// balance steps only happen for autogrants with AMOUNT_OWED_WRITEBACK set and
+// follow the same rule.
+const (
+	stepPlanned         = "planned"
+	stepRecordCreated   = "record_created"
+	stepTransferStarted = "transfer_started"
+	stepTransferFailed  = "transfer_failed"
+	stepTransferSent    = "transfer_sent"
+	stepStatusUpdated   = "status_updated"
+	stepBalanceStarted  = "balance_started"
+	stepBalanceUpdated  = "balance_updated"
+)
+
+var errTransferUnknown = errors.New("the HCB transfer may or may not exist; check HCB and `cash-cannon reconcile` before sending it again")
+
+// retryable reports whether the event failed before any money could have
+// moved. Results from before checkpoints were recorded have no step.
+func (result RunResult) retryable() bool {
+	if result.Status != "failed" {
+		return false
+	}
+	switch result.Step {
+	case "", stepPlanned, stepRecordCreated, stepTransferFailed:
+		return true
+	}
+	return false
+}
+
+// completedEvents counts the events that have a final status.
+func (run *Run) completedEvents() int {
+	completed := 0
+	for _, result := range run.Results {
+		if result.Status != "" {
+			completed++
+		}
+	}
+	return completed
+}
+
+func newRun(plan Plan, source, operator string) *Run {
+	return &Run{
+		ID:        newRunID(),
+		Mode:      plan.Mode,
+		Source:    source,
+		Operator:  operator,
+		Status:    "planned",
+		CreatedAt: time.Now(),
+		Plan:      plan,
+	}
+}
+
+func newRunID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return "run_" + time.Now().UTC().Format("20060102T150405") + "_" + hex.EncodeToString(b)
+}
+
+// runMu serializes runs so the scheduler, the dashboard and retries never
+// disburse concurrently. The file lock at runLockPath does the same between
+// processes, so a CLI run and the server never send at the same time.
+var runMu sync.Mutex
+
+func runLockPath() string {
+	return filepath.Join(dataDir(), "run.lock")
+}
+
+// lockRuns takes runMu and the run file lock, waiting for a run in another
+// process to finish.
+func lockRuns(ctx context.Context) (func(), error) {
+	runMu.Lock()
+	unlock, ok, err := tryLockFile(runLockPath())
+	if err == nil && !ok {
+		slog.WarnContext(ctx, "Another process is executing a run; waiting for it to finish")
+		unlock, err = lockFile(runLockPath())
+	}
+	if err != nil {
+		runMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		runMu.Unlock()
+	}, nil
+}
+
+// runLockHeld reports whether another process is executing a run.
+func runLockHeld() bool {
+	unlock, ok, err := tryLockFile(runLockPath())
+	if err != nil || !ok {
+		return err == nil
+	}
+	unlock()
+	return false
+}
+
+// startRun executes a new run built from live amount_owed. The plan was
+// built before the run lock was taken, and the run holding it may have paid
+// the same balances in the meantime, so once the lock is held replan builds
+// the plan again and the run is refused with a *planChangedError if it
+// differs. Nothing is saved for a refused run. replan only reads Airtable, so
+// its failures are wrapped in errAirtable.
+func startRun(ctx context.Context, run *Run, replan func(context.Context) (Plan, error)) error {
+	unlock, err := lockRuns(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to take the run lock: %v", err)
+	}
+	defer unlock()
+
+	current, err := replan(ctx)
+	if err != nil {
+		return fmt.Errorf("%w while checking the plan: %v", errAirtable, err)
+	}
+	if diffs := current.differences(run.Plan.expected()); len(diffs) > 0 {
+		slog.WarnContext(withLogAttrs(ctx, "run_id", run.ID), "Run refused: the plan no longer matches live balances",
+			"differences", len(diffs))
+		return &planChangedError{differences: diffs}
+	}
+	executeLocked(ctx, run)
+	return nil
+}
+
+// executeRun sends every remaining item in the run's plan and records the
+// outcome in the run history. Each event is checkpointed after every step, so
+// a run interrupted by shutdown or killed outright is resumed by calling
+// executeRun again: finished events are skipped and an event in progress
+// picks up after its last completed step. Autogrant runs also refresh the
+// dashboard statistics.
+func executeRun(ctx context.Context, run *Run) {
+	unlock, err := lockRuns(ctx)
+	if err != nil {
+		slog.ErrorContext(withLogAttrs(ctx, "run_id", run.ID), "Failed to take the run lock; run not started", "error", err)
+		run.Status = "interrupted"
+		if err := runStore.Save(run); err != nil {
+			slog.ErrorContext(ctx, "Failed to record run", "error", err)
+		}
+		return
+	}
+	defer unlock()
+	executeLocked(ctx, run)
+}
+
+// executeLocked is executeRun once the run lock is held.
+func executeLocked(ctx context.Context, run *Run) {
+	// A client disconnect or request timeout must never stop a run between
+	// the HCB transfer and the Airtable status update; shutdown is handled
+	// between events instead.
+	ctx = context.WithoutCancel(ctx)
+
+	ctx = withLogAttrs(ctx, "run_id", run.ID)
+	ctx, span := tracer.Start(ctx, "run", trace.WithAttributes(
+		attribute.String("run.id", run.ID),
+		attribute.String("run.mode", run.Mode),
+		attribute.String("run.source", run.Source),
+		attribute.Int("run.events", len(run.Plan.Items)),
+		attribute.Int("run.resume_from", run.completedEvents()),
+		attribute.Float64("run.total_amount", run.Plan.TotalAmount),
+	))
+	defer span.End()
+
+	if run.StartedAt.IsZero() {
+		run.StartedAt = time.Now()
+	}
+	run.Status = "running"
+	if err := runStore.Save(run); err != nil {
+		slog.ErrorContext(ctx, "Failed to record run", "error", err)
+	}
+
+	notifyRunStarted(ctx, run)
+
+	for i, item := range run.Plan.Items {
+		if i < len(run.Results) && run.Results[i].Status != "" {
+			continue
+		}
+		if i == len(run.Results) {
+			if isDraining() {
+				interruptRun(ctx, run)
+				return
+			}
+			// Counted once, here: a resumed event already was
+			run.Results = append(run.Results, RunResult{PlanItem: item, Step: stepPlanned})
+			run.Created++
+			recordTransferAttempt(run.Mode, item.Amount)
+		}
+
+		executeItem(ctx, run, &run.Results[i])
+		if err := runStore.Save(run); err != nil {
+			slog.ErrorContext(ctx, "Failed to record run progress", "error", err)
+		}
+	}
+
+	finished := time.Now()
+	run.FinishedAt = &finished
+	runDuration.WithLabelValues(run.Mode).Observe(finished.Sub(run.StartedAt).Seconds())
+	span.SetAttributes(attribute.Int("run.processed", run.Processed), attribute.Int("run.failed", run.Failed))
+	run.Status = "completed"
+	if err := runStore.Save(run); err != nil {
+		slog.ErrorContext(ctx, "Failed to record run", "error", err)
+	}
+
+	if run.Mode == "autogrant" {
+		recordStats(run)
+	}
+
+	notifyRunCompleted(ctx, run)
+	fireRunCompletedWebhook(ctx, run)
+}
+
+// executeItem carries one event through create → transfer → update from its
+// last checkpoint and records the outcome in result.
+func executeItem(ctx context.Context, run *Run, result *RunResult) {
+	ctx = withLogAttrs(ctx, "event_record_id", result.RecordID, "hcb_event_id", result.HCBEventID)
+	ctx, span := tracer.Start(ctx, "disbursement", trace.WithAttributes(
+		attribute.String("event.record_id", result.RecordID),
+		attribute.String("event.hcb_event_id", result.HCBEventID),
+		attribute.Float64("disbursement.amount", result.Amount),
+		attribute.String("disbursement.direction", result.Direction),
+		attribute.String("disbursement.resume_step", result.Step),
+	))
+
+	checkpoint := func() {
+		if err := runStore.Save(run); err != nil {
+			slog.ErrorContext(ctx, "Failed to record checkpoint", "step", result.Step, "error", err)
+		}
+		if result.Step == stepRecordCreated {
+			created := *result
+			created.Status = "pending"
+			fireDisbursementWebhook(ctx, webhookDisbursementCreated, run, created)
+		}
+	}
+
+	text := TransferText{
+		Type:       disbursementTypeFor(run.Mode, result.Amount),
+		RunID:      run.ID,
+		Operator:   run.Operator,
+		Memo:       result.Memo,
+		RecordID:   result.RecordID,
+		HCBEventID: result.HCBEventID,
+		Amount:     math.Abs(result.Amount),
+	}
+
+	var err error
+	if run.Mode == "custom" {
+		err = processCustomDisbursement(ctx, result.event(), result.Amount, text, result, checkpoint)
+	} else {
+		err = processDisbursement(ctx, result.event(), text, result, checkpoint)
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Error processing disbursement", "mode", run.Mode,
+			"disbursement_id", result.DisbursementID, "step", result.Step, "error", err)
+		result.Status = "failed"
+		if errors.Is(err, errTransferUnknown) || errors.Is(err, errBalanceUnknown) {
+			result.Status = "unknown"
+		}
+		result.Error = err.Error()
+		run.Failed++
+		notifyDisbursementFailed(ctx, run, *result)
+		fireDisbursementWebhook(ctx, webhookDisbursementFailed, run, *result)
+	} else {
+		result.Status = "processed"
+		run.Processed++
+		fireDisbursementWebhook(ctx, webhookDisbursementProcessed, run, *result)
+	}
+	recordTransferMetrics(run.Mode, *result)
+	span.SetAttributes(attribute.Int("disbursement.id", result.DisbursementID))
+	endSpan(span, err)
+}
+
+// interruptRun stops a run between events during shutdown. The remaining
+// events stay in the plan, after the saved results, ready to resume.
+func interruptRun(ctx context.Context, run *Run) {
+	run.Status = "interrupted"
+	if err := runStore.Save(run); err != nil {
+		slog.ErrorContext(ctx, "Failed to record interrupted run", "error", err)
+	}
+	remaining := len(run.Plan.Items) - len(run.Results)
+	slog.WarnContext(ctx, "Run interrupted by shutdown", "completed", len(run.Results), "remaining", remaining)
+	postSlack(ctx, fmt.Sprintf(":pause_button: Run `%s` interrupted by shutdown after %d of %d events; %d remaining",
+		run.ID, len(run.Results), len(run.Plan.Items), remaining))
+}
+
+func recordStats(run *Run) {
+	stats = DisbursementStats{
+		TotalEvents:          run.Plan.TotalEvents,
+		DisbursementsCreated: run.Created,
+		ProcessedCount:       run.Processed,
+		FailedCount:          run.Failed,
+		LastRun:              run.StartedAt,
+	}
+	for _, item := range run.Plan.Items {
+		if item.Amount > 0 {
+			stats.EventsWithAmount++
+			stats.TotalAmountOwed += item.Amount
+		}
+	}
+}
+
+// retryPlan builds a plan from the failed results of an earlier, completed
+// run. Events whose transfer was sent, or may have been, are left for
+// reconcile, and events another retry already took are left out.
+func retryPlan(run *Run) (Plan, error) {
+	if run.Status != "completed" {
+		return Plan{}, wrongStatus(run.ID, run.Status, "completed")
+	}
+	plan := Plan{Mode: run.Mode, CustomAmount: run.Plan.CustomAmount, Upload: run.Plan.Upload, Memo: run.Plan.Memo, Target: run.Plan.Target, TotalEvents: run.Plan.TotalEvents}
+	for _, result := range run.Results {
+		if result.retryable() && result.RetriedBy == "" {
+			plan.Items = append(plan.Items, result.PlanItem)
+			plan.TotalAmount += result.Amount
+		}
+	}
+	plan.EventCount = len(plan.Items)
+	return plan, nil
+}
+
+// claimRetry marks the results a retry run re-sends as retried by it, in one
+// update of the original run, so two retries of the same run (two operators,
+// or a double-click) never send the same failure twice. It fails with a
+// *runStateError if another retry claimed any of them first.
+func claimRetry(run *Run) error {
+	_, err := runStore.Update(run.RetryOf, func(previous *Run) error {
+		if previous.Status != "completed" {
+			return wrongStatus(previous.ID, previous.Status, "completed")
+		}
+		byRecord := make(map[string]int)
+		for i, result := range previous.Results {
+			byRecord[result.RecordID] = i
+		}
+		for _, item := range run.Plan.Items {
+			i, ok := byRecord[item.RecordID]
+			if !ok || !previous.Results[i].retryable() {
+				return &runStateError{fmt.Sprintf("event %s of run %s is not safe to retry", item.HCBEventID, previous.ID)}
+			}
+			if by := previous.Results[i].RetriedBy; by != "" {
+				return &runStateError{fmt.Sprintf("event %s of run %s was already retried by %s", item.HCBEventID, previous.ID, by)}
+			}
+			previous.Results[i].RetriedBy = run.ID
+		}
+		return nil
+	})
+	return err
+}
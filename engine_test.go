@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Requests the engine makes, as recorded by stubUpstream.
+const (
+	reqCreateRecord = "airtable POST disbursements"
+	reqUpdateRecord = "airtable PATCH disbursements"
+	reqReadEvent    = "airtable GET events"
+	reqUpdateEvent  = "airtable PATCH events"
+	reqTransfer     = "hcb POST transfers"
+)
+
+// stubUpstream stands in for Airtable and HCB. It records every request as
+// "<service> <method> <resource>" and answers transfer requests with
+// transferStatus, or fails them with transferErr before they reach it.
+// responses holds canned bodies for GET requests, by path.
+type stubUpstream struct {
+	mu             sync.Mutex
+	server         *httptest.Server
+	requests       []string
+	transferStatus int
+	transferErr    error
+	records        int
+	responses      map[string]interface{}
+}
+
+// newStubUpstream points airtableClient and hcbClient at a stub for the
+// duration of the test, with the run history in a temporary directory.
+func newStubUpstream(t *testing.T) *stubUpstream {
+	t.Helper()
+	stub := &stubUpstream{transferStatus: http.StatusOK}
+	stub.server = httptest.NewServer(http.HandlerFunc(stub.serve))
+	t.Cleanup(stub.server.Close)
+
+	for _, client := range []*http.Client{airtableClient, hcbClient} {
+		transport := client.Transport.(*instrumentedTransport)
+		base := transport.base
+		transport.base = stub
+		t.Cleanup(func() { transport.base = base })
+	}
+
+	dir := t.TempDir()
+	t.Setenv("DATA_DIR", dir)
+	t.Setenv("AIRTABLE_BASE_ID", "appTest")
+	t.Setenv("AMOUNT_OWED_WRITEBACK", "")
+	t.Setenv("WEBHOOK_URLS", "")
+	t.Setenv("SLACK_WEBHOOK_URL", "")
+	previous := runStore.dir
+	runStore.dir = dir + "/runs"
+	t.Cleanup(func() { runStore.dir = previous })
+	return stub
+}
+
+// RoundTrip records the request and sends it to the stub server.
+func (s *stubUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	service := "airtable"
+	if req.URL.Host == "hcb.hackclub.com" {
+		service = "hcb"
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	resource := parts[len(parts)-1]
+	if service == "airtable" && len(parts) >= 3 {
+		resource = parts[2]
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, service+" "+req.Method+" "+resource)
+	err := s.transferErr
+	s.mu.Unlock()
+	if service == "hcb" && resource == "transfers" && err != nil {
+		return nil, err
+	}
+
+	forwarded := req.Clone(req.Context())
+	forwarded.URL.Scheme = "http"
+	forwarded.URL.Host = strings.TrimPrefix(s.server.URL, "http://")
+	forwarded.Host = forwarded.URL.Host
+	forwarded.Header.Set("X-Service", service)
+	return http.DefaultTransport.RoundTrip(forwarded)
+}
+
+func (s *stubUpstream) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var request struct {
+		Fields map[string]interface{} `json:"fields"`
+	}
+	json.Unmarshal(body, &request)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if response, ok := s.responses[r.URL.Path]; ok && r.Method == "GET" {
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	switch {
+	case r.Header.Get("X-Service") == "hcb":
+		w.WriteHeader(s.transferStatus)
+		if s.transferStatus >= 300 {
+			fmt.Fprint(w, `{"error":"refused"}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"xfr_test","status":"pending"}`)
+	case strings.HasSuffix(r.URL.Path, "/disbursements") && r.Method == "POST":
+		s.records++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":     fmt.Sprintf("recDisb%09d", s.records),
+			"fields": map[string]interface{}{"disbursement_id": s.records},
+		})
+	case strings.Contains(r.URL.Path, "/events/") && r.Method == "GET":
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "recEvent", "fields": map[string]interface{}{"amount_disbursed": 0.0}})
+	default:
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "recStub", "fields": request.Fields})
+	}
+}
+
+func (s *stubUpstream) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *stubUpstream) transfers() int {
+	count := 0
+	for _, request := range s.sent() {
+		if request == reqTransfer {
+			count++
+		}
+	}
+	return count
+}
+
+var allSteps = []string{stepPlanned, stepRecordCreated, stepTransferStarted, stepTransferFailed,
+	stepTransferSent, stepStatusUpdated, stepBalanceStarted, stepBalanceUpdated}
+
+// processFrom runs one event of the mode from a checkpoint at step and
+// returns its progress and error.
+func processFrom(mode, step string) (*RunResult, error) {
+	item := PlanItem{RecordID: "recEvent0000001", HCBEventID: "hq", Amount: 25, Direction: "grant"}
+	progress := &RunResult{PlanItem: item, Step: step}
+	if step != stepPlanned {
+		progress.DisbursementRecordID = "recDisb000000000"
+		progress.DisbursementID = 7
+	}
+	text := TransferText{Type: disbursementTypeFor(mode, item.Amount), RecordID: item.RecordID, HCBEventID: item.HCBEventID, Amount: item.Amount}
+
+	ctx := context.Background()
+	if mode == "custom" {
+		return progress, processCustomDisbursement(ctx, item.event(), item.Amount, text, progress, func() {})
+	}
+	return progress, processDisbursement(ctx, item.event(), text, progress, func() {})
+}
+
+func TestProcessFromEachStep(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		mode     string
+		step     string
+		requests []string
+		err      error
+		endStep  string
+	}{
+		{"autogrant", stepPlanned, []string{reqCreateRecord, reqTransfer, reqUpdateRecord, reqReadEvent, reqUpdateEvent}, nil, stepBalanceUpdated},
+		{"autogrant", stepRecordCreated, []string{reqTransfer, reqUpdateRecord, reqReadEvent, reqUpdateEvent}, nil, stepBalanceUpdated},
+		{"autogrant", stepTransferStarted, nil, errTransferUnknown, stepTransferStarted},
+		{"autogrant", stepTransferFailed, []string{reqUpdateRecord}, errFailed, stepTransferFailed},
+		{"autogrant", stepTransferSent, []string{reqUpdateRecord, reqReadEvent, reqUpdateEvent}, nil, stepBalanceUpdated},
+		{"autogrant", stepStatusUpdated, []string{reqReadEvent, reqUpdateEvent}, nil, stepBalanceUpdated},
+		{"autogrant", stepBalanceStarted, nil, errBalanceUnknown, stepBalanceStarted},
+		{"autogrant", stepBalanceUpdated, nil, nil, stepBalanceUpdated},
+
+		{"custom", stepPlanned, []string{reqCreateRecord, reqTransfer, reqUpdateRecord}, nil, stepStatusUpdated},
+		{"custom", stepRecordCreated, []string{reqTransfer, reqUpdateRecord}, nil, stepStatusUpdated},
+		{"custom", stepTransferStarted, nil, errTransferUnknown, stepTransferStarted},
+		{"custom", stepTransferFailed, []string{reqUpdateRecord}, errFailed, stepTransferFailed},
+		{"custom", stepTransferSent, []string{reqUpdateRecord}, nil, stepStatusUpdated},
+		{"custom", stepStatusUpdated, nil, nil, stepStatusUpdated},
+		// Custom runs never write balances; these only occur in autogrant runs.
+		{"custom", stepBalanceStarted, nil, nil, stepBalanceStarted},
+		{"custom", stepBalanceUpdated, nil, nil, stepBalanceUpdated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+tt.step, func(t *testing.T) {
+			stub := newStubUpstream(t)
+			t.Setenv("AMOUNT_OWED_WRITEBACK", writebackIncrement)
+
+			progress, err := processFrom(tt.mode, tt.step)
+
+			switch {
+			case tt.err == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err == errFailed && (err == nil || errors.Is(err, errTransferUnknown)):
+				t.Fatalf("error = %v, want a definite failure", err)
+			case tt.err != nil && tt.err != errFailed && !errors.Is(err, tt.err):
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			if got := stub.sent(); !reflect.DeepEqual(got, tt.requests) {
+				t.Errorf("requests = %q, want %q", got, tt.requests)
+			}
+			if progress.Step != tt.endStep {
+				t.Errorf("step = %s, want %s", progress.Step, tt.endStep)
+			}
+		})
+	}
+}
+
+func TestTransferErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		err      error
+		endStep  string
+		unknown  bool
+		requests []string
+	}{
+		{"refused", http.StatusUnprocessableEntity, nil, stepTransferFailed, false, []string{reqTransfer, reqUpdateRecord}},
+		{"server error", http.StatusInternalServerError, nil, stepTransferStarted, true, []string{reqTransfer}},
+		{"unavailable", http.StatusServiceUnavailable, nil, stepTransferStarted, true, []string{reqTransfer}},
+		{"gateway timeout", http.StatusGatewayTimeout, nil, stepTransferStarted, true, []string{reqTransfer}},
+		{"bad gateway", http.StatusBadGateway, nil, stepTransferStarted, true, []string{reqTransfer}},
+		{"transport error", http.StatusOK, errors.New("connection reset by peer"), stepTransferStarted, true, []string{reqTransfer}},
+	}
+
+	for _, mode := range []string{"autogrant", "custom"} {
+		for _, tt := range tests {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				stub := newStubUpstream(t)
+				stub.transferStatus = tt.status
+				stub.transferErr = tt.err
+
+				progress, err := processFrom(mode, stepRecordCreated)
+
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if errors.Is(err, errTransferUnknown) != tt.unknown {
+					t.Errorf("error = %v, unknown = %v, want %v", err, !tt.unknown, tt.unknown)
+				}
+				if progress.Step != tt.endStep {
+					t.Errorf("step = %s, want %s", progress.Step, tt.endStep)
+				}
+				if got := stub.sent(); !reflect.DeepEqual(got, tt.requests) {
+					t.Errorf("requests = %q, want %q", got, tt.requests)
+				}
+			})
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	// Steps at which a transfer may already exist on HCB.
+	mayExist := map[string]bool{
+		stepTransferStarted: true,
+		stepTransferSent:    true,
+		stepStatusUpdated:   true,
+		stepBalanceStarted:  true,
+		stepBalanceUpdated:  true,
+	}
+
+	for _, step := range append([]string{""}, allSteps...) {
+		for _, status := range []string{"failed", "unknown", "processed"} {
+			result := RunResult{Step: step, Status: status}
+			want := status == "failed" && !mayExist[step]
+			if got := result.retryable(); got != want {
+				t.Errorf("retryable() for %s at %q = %v, want %v", status, step, got, want)
+			}
+		}
+	}
+}
+
+// TestRetryNeverResends executes the retry of a run with an event failed at
+// every step and checks that only events whose transfer cannot exist are
+// sent again.
+func TestRetryNeverResends(t *testing.T) {
+	for _, mode := range []string{"autogrant", "custom"} {
+		t.Run(mode, func(t *testing.T) {
+			stub := newStubUpstream(t)
+
+			previous := &Run{ID: "run_previous", Mode: mode, Status: "completed"}
+			var want []string
+			for i, step := range allSteps {
+				item := PlanItem{RecordID: fmt.Sprintf("recEvent%07d", i), HCBEventID: "hq", Amount: 10, Direction: "grant"}
+				status := "failed"
+				if step == stepTransferStarted || step == stepBalanceStarted {
+					status = "unknown"
+				}
+				previous.Plan.Items = append(previous.Plan.Items, item)
+				previous.Results = append(previous.Results, RunResult{PlanItem: item, Step: step, Status: status})
+				if step == stepPlanned || step == stepRecordCreated || step == stepTransferFailed {
+					want = append(want, item.RecordID)
+				}
+			}
+
+			if err := runStore.Save(previous); err != nil {
+				t.Fatal(err)
+			}
+
+			plan, err := retryPlan(previous)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, item := range plan.Items {
+				got = append(got, item.RecordID)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("retry plan = %q, want %q", got, want)
+			}
+
+			run := newRun(plan, "cli", "test")
+			run.RetryOf = previous.ID
+			// A second retry built from the same plan, e.g. a double-click
+			second := newRun(plan, "cli", "test")
+			second.RetryOf = previous.ID
+			if err := claimRetry(run); err != nil {
+				t.Fatal(err)
+			}
+			var stateErr *runStateError
+			if err := claimRetry(second); !errors.As(err, &stateErr) {
+				t.Errorf("second claim error = %v, want a run state error", err)
+			}
+			executeRun(context.Background(), run)
+			if sent := stub.transfers(); sent != len(want) {
+				t.Errorf("retry sent %d transfers, want %d", sent, len(want))
+			}
+			if run.Processed != len(want) {
+				t.Errorf("retry processed %d events, want %d", run.Processed, len(want))
+			}
+
+			stored, err := runStore.Get(previous.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := retryPlan(stored); len(again.Items) != 0 {
+				t.Errorf("retrying again plans %d events, want none", len(again.Items))
+			}
+			previous.Status = "running"
+			if _, err := retryPlan(previous); !errors.As(err, &stateErr) {
+				t.Errorf("retrying a running run: error = %v, want a run state error", err)
+			}
+		})
+	}
+}
+
+// TestStartRunRechecksPlan checks that a run whose balances changed while it
+// waited for the run lock sends nothing.
+func TestStartRunRechecksPlan(t *testing.T) {
+	item := PlanItem{RecordID: "recEvent0000001", HCBEventID: "hq", Amount: 25, Direction: "grant"}
+	plan := Plan{Mode: "autogrant", Items: []PlanItem{item}, EventCount: 1, TotalAmount: 25}
+
+	tests := []struct {
+		name    string
+		current []PlanItem
+		sent    int
+	}{
+		{"unchanged", []PlanItem{item}, 1},
+		{"paid while waiting", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newStubUpstream(t)
+			run := newRun(plan, "dashboard", "test")
+
+			err := startRun(context.Background(), run, func(context.Context) (Plan, error) {
+				return Plan{Mode: "autogrant", Items: tt.current}, nil
+			})
+			var changed *planChangedError
+			if errors.As(err, &changed) != (tt.sent == 0) {
+				t.Errorf("error = %v, want a plan change %v", err, tt.sent == 0)
+			}
+			if sent := stub.transfers(); sent != tt.sent {
+				t.Errorf("sent %d transfers, want %d", sent, tt.sent)
+			}
+		})
+	}
+}
+
+// TestResumeCountsEventsOnce resumes a run killed after its first event's
+// transfer was sent and checks that the event is not counted again.
+func TestResumeCountsEventsOnce(t *testing.T) {
+	stub := newStubUpstream(t)
+
+	items := []PlanItem{
+		{RecordID: "recEvent0000001", HCBEventID: "hq", Amount: 10, Direction: "grant"},
+		{RecordID: "recEvent0000002", HCBEventID: "hq", Amount: 10, Direction: "grant"},
+	}
+	run := newRun(Plan{Mode: "custom", Items: items, EventCount: 2, TotalAmount: 20}, "dashboard", "test")
+	run.Status = "interrupted"
+	run.Created = 1
+	run.Results = []RunResult{{PlanItem: items[0], DisbursementRecordID: "recDisb000000000", HCBTransferID: "xfr_test", Step: stepTransferSent}}
+
+	attempted := attemptedTransfers("miscellaneous")
+	executeRun(context.Background(), run)
+
+	if run.Created != 2 {
+		t.Errorf("created = %d, want 2", run.Created)
+	}
+	if got := attemptedTransfers("miscellaneous") - attempted; got != 1 {
+		t.Errorf("attempted counter rose by %v, want 1", got)
+	}
+	if sent := stub.transfers(); sent != 1 {
+		t.Errorf("sent %d transfers, want 1", sent)
+	}
+}
+
+func attemptedTransfers(disbursementType string) float64 {
+	var metric dto.Metric
+	transfersAttempted.WithLabelValues(disbursementType).Write(&metric)
+	return metric.GetCounter().GetValue()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Exports are for finance and cover the same entries as the disbursement
+// history, usually narrowed to a run or a date range. Amounts are signed the
+// way sendHCBTransfer moves money: positive is paid from Campfire to the
+// event, negative is pulled back from the event to Campfire. Totals only
+// count money that moved, i.e. processed disbursements HCB has not rejected.
+//
+// The journal format has a debit and a credit line per disbursement, in the
+// column layout QuickBooks and Xero journal imports accept. The accounts are
+// JOURNAL_GRANTS_ACCOUNT (default "Event Grants") and JOURNAL_BANK_ACCOUNT
+// (default "HCB Campfire").
+var exportFormats = []string{"csv", "json", "journal"}
+
+const (
+	defaultJournalGrantsAccount = "Event Grants"
+	defaultJournalBankAccount   = "HCB Campfire"
+)
+
+// ExportTotals sums the money that moved, per disbursement type.
+type ExportTotals struct {
+	ByType map[string]float64 `json:"by_type"`
+	Net    float64            `json:"net"`
+	Count  int                `json:"count"`
+}
+
+func exportTotals(entries []DisbursementEntry) ExportTotals {
+	totals := ExportTotals{ByType: make(map[string]float64)}
+	for _, entry := range entries {
+		if !moneyMoved(entry) {
+			continue
+		}
+		totals.ByType[entry.Type] = roundCents(totals.ByType[entry.Type] + entry.Amount)
+		totals.Net = roundCents(totals.Net + entry.Amount)
+		totals.Count++
+	}
+	return totals
+}
+
+func moneyMoved(entry DisbursementEntry) bool {
+	return entry.Status == "processed" && transferState(entry.HCBTransferStatus) != transferRejected
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+func validExportFormat(format string) bool {
+	for _, f := range exportFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// exportContentType and exportExtension describe the file for each format.
+func exportContentType(format string) string {
+	if format == "json" {
+		return "application/json"
+	}
+	return "text/csv"
+}
+
+func exportExtension(format string) string {
+	if format == "json" {
+		return "json"
+	}
+	return "csv"
+}
+
+// writeExport writes entries, oldest first, in format.
+func writeExport(w io.Writer, format string, entries []DisbursementEntry) error {
+	ordered := append([]DisbursementEntry(nil), entries...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].At.Before(ordered[j].At) })
+
+	switch format {
+	case "json":
+		return writeJSONExport(w, ordered)
+	case "journal":
+		return writeJournalExport(w, ordered)
+	case "csv":
+		return writeCSVExport(w, ordered)
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+func writeJSONExport(w io.Writer, entries []DisbursementEntry) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		GeneratedAt   time.Time           `json:"generated_at"`
+		Disbursements []DisbursementEntry `json:"disbursements"`
+		Totals        ExportTotals        `json:"totals"`
+	}{time.Now().UTC(), entries, exportTotals(entries)})
+}
+
+func writeCSVExport(w io.Writer, entries []DisbursementEntry) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"date", "run_id", "operator", "disbursement_type", "direction", "hcb_event_id", "event_record_id",
+		"disbursement_id", "disbursement_record_id", "amount", "status", "hcb_transfer_id", "hcb_transfer_status", "memo", "error"})
+	for _, entry := range entries {
+		disbursementID := ""
+		if entry.DisbursementID != 0 {
+			disbursementID = strconv.Itoa(entry.DisbursementID)
+		}
+		out.Write([]string{entry.At.UTC().Format(time.RFC3339), entry.RunID, entry.Operator, entry.Type, entry.Direction,
+			entry.HCBEventID, entry.RecordID, disbursementID, entry.DisbursementRecordID, formatAmount(entry.Amount),
+			entry.Status, entry.HCBTransferID, entry.HCBTransferStatus, entry.Memo, entry.Error})
+	}
+
+	totals := exportTotals(entries)
+	out.Write(nil)
+	for _, disbursementType := range transferTypes {
+		if amount, ok := totals.ByType[disbursementType]; ok {
+			out.Write([]string{"total", "", "", disbursementType, "", "", "", "", "", formatAmount(amount)})
+		}
+	}
+	out.Write([]string{"total", "", "", "net", "", "", "", "", "", formatAmount(totals.Net)})
+
+	out.Flush()
+	return out.Error()
+}
+
+// writeJournalExport writes two balanced lines per disbursement that moved
+// money: a grant debits the grants account and credits the bank, a
+// withdrawal or clawback the reverse.
+func writeJournalExport(w io.Writer, entries []DisbursementEntry) error {
+	grants := os.Getenv("JOURNAL_GRANTS_ACCOUNT")
+	if grants == "" {
+		grants = defaultJournalGrantsAccount
+	}
+	bank := os.Getenv("JOURNAL_BANK_ACCOUNT")
+	if bank == "" {
+		bank = defaultJournalBankAccount
+	}
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"JournalNo", "JournalDate", "AccountName", "Debits", "Credits", "Description", "Name", "Memo"})
+	for _, entry := range entries {
+		if !moneyMoved(entry) {
+			continue
+		}
+		number := fmt.Sprintf("CC-%d", entry.DisbursementID)
+		date := entry.At.Format("2006-01-02")
+		description := fmt.Sprintf("Campfire %s disbursement %d (HCB transfer %s)", entry.Type, entry.DisbursementID, entry.HCBTransferID)
+		amount := formatAmount(math.Abs(entry.Amount))
+
+		debit, credit := grants, bank
+		if entry.Amount < 0 {
+			debit, credit = bank, grants
+		}
+		out.Write([]string{number, date, debit, amount, "", description, entry.HCBEventID, entry.Memo})
+		out.Write([]string{number, date, credit, "", amount, description, entry.HCBEventID, entry.Memo})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(roundCents(amount), 'f', 2, 64)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The disbursement history is built from the run history: every event a run
+// got to is one entry, newest run first. Drill-down adds the Airtable record,
+// for its notes, and HCB's current view of the transfer.
+const (
+	historyPageSize    = 50
+	historyMaxPageSize = 200
+)
+
+// DisbursementEntry is one disbursement from the run history.
+type DisbursementEntry struct {
+	RunResult
+	RunID    string    `json:"run_id"`
+	Mode     string    `json:"mode"`
+	Source   string    `json:"source"`
+	Operator string    `json:"operator,omitempty"`
+	Type     string    `json:"disbursement_type"`
+	At       time.Time `json:"at"`
+}
+
+// DisbursementPage is one page of the disbursement history.
+type DisbursementPage struct {
+	Disbursements []DisbursementEntry `json:"disbursements"`
+	Page          int                 `json:"page"`
+	PerPage       int                 `json:"per_page"`
+	Pages         int                 `json:"pages"`
+	Total         int                 `json:"total"`
+}
+
+// DisbursementDetail is a disbursement's run history entry, if it has one,
+// with its Airtable record and HCB's current view of the transfer. Upstream
+// errors are reported alongside whatever could be loaded.
+type DisbursementDetail struct {
+	Disbursement  *DisbursementEntry            `json:"disbursement"`
+	Airtable      *AirtableDisbursementResponse `json:"airtable,omitempty"`
+	AirtableError string                        `json:"airtable_error,omitempty"`
+	HCBTransfer   json.RawMessage               `json:"hcb_transfer,omitempty"`
+	HCBError      string                        `json:"hcb_error,omitempty"`
+}
+
+// HistoryFilter selects entries; empty fields match everything. Status is a
+// run result status (processed, failed, unknown) or, for processed entries,
+// the transfer state (submitted, completed, rejected).
+type HistoryFilter struct {
+	RunID    string
+	Status   string
+	Type     string
+	Event    string
+	Operator string
+	From     time.Time
+	To       time.Time
+}
+
+// parseHistoryFilter reads the run, status, type, event, operator, from and
+// to query parameters; from and to are dates (YYYY-MM-DD) and include the
+// whole day.
+func parseHistoryFilter(get func(string) string) (HistoryFilter, error) {
+	filter := HistoryFilter{
+		RunID:    strings.TrimSpace(get("run")),
+		Status:   strings.TrimSpace(get("status")),
+		Type:     strings.TrimSpace(get("type")),
+		Event:    strings.ToLower(strings.TrimSpace(get("event"))),
+		Operator: strings.ToLower(strings.TrimSpace(get("operator"))),
+	}
+	if from := get("from"); from != "" {
+		t, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			return HistoryFilter{}, fmt.Errorf("from %q is not a date (YYYY-MM-DD)", from)
+		}
+		filter.From = t
+	}
+	if to := get("to"); to != "" {
+		t, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			return HistoryFilter{}, fmt.Errorf("to %q is not a date (YYYY-MM-DD)", to)
+		}
+		filter.To = t.AddDate(0, 0, 1)
+	}
+	return filter, nil
+}
+
+func (filter HistoryFilter) matches(entry DisbursementEntry) bool {
+	if filter.RunID != "" && filter.RunID != entry.RunID {
+		return false
+	}
+	if filter.Status != "" && filter.Status != entry.Status &&
+		!(entry.Status == "processed" && filter.Status == transferState(entry.HCBTransferStatus)) {
+		return false
+	}
+	if filter.Type != "" && filter.Type != entry.Type {
+		return false
+	}
+	if filter.Event != "" && !strings.Contains(strings.ToLower(entry.HCBEventID), filter.Event) &&
+		!strings.EqualFold(entry.RecordID, filter.Event) {
+		return false
+	}
+	if filter.Operator != "" && !strings.Contains(strings.ToLower(entry.Operator), filter.Operator) {
+		return false
+	}
+	if !filter.From.IsZero() && entry.At.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && !entry.At.Before(filter.To) {
+		return false
+	}
+	return true
+}
+
+// listDisbursements returns the entries the filter matches, newest first.
+func listDisbursements(filter HistoryFilter) ([]DisbursementEntry, error) {
+	runs, err := runStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []DisbursementEntry{}
+	for _, run := range runs {
+		at := run.StartedAt
+		if at.IsZero() {
+			at = run.CreatedAt
+		}
+		for _, result := range run.Results {
+			entry := DisbursementEntry{
+				RunResult: result,
+				RunID:     run.ID,
+				Mode:      run.Mode,
+				Source:    run.Source,
+				Operator:  run.Operator,
+				Type:      disbursementTypeFor(run.Mode, result.Amount),
+				At:        at,
+			}
+			if filter.matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// findDisbursement returns the entry for a disbursement record, if it is in
+// the run history.
+func findDisbursement(recordID string) (*DisbursementEntry, error) {
+	entries, err := listDisbursements(HistoryFilter{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i].DisbursementRecordID == recordID {
+			return &entries[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// disbursementDetail loads the detail for a disbursement record. It fails
+// with errNotFound when the record is in neither the run history nor
+// Airtable, and with errAirtable when it is not in the run history and
+// Airtable could not be asked.
+func disbursementDetail(ctx context.Context, recordID string) (*DisbursementDetail, error) {
+	entry, err := findDisbursement(recordID)
+	if err != nil {
+		return nil, err
+	}
+	detail := &DisbursementDetail{Disbursement: entry}
+
+	transferID := ""
+	if entry != nil {
+		transferID = entry.HCBTransferID
+	}
+	record, err := getDisbursementRecord(ctx, recordID)
+	if err != nil {
+		if entry == nil && errors.Is(err, errNotFound) {
+			return nil, err
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("%w for disbursement %s: %v", errAirtable, recordID, err)
+		}
+		detail.AirtableError = err.Error()
+	} else {
+		detail.Airtable = record
+		if transferID == "" {
+			transferID = record.Fields.HCBTransferID
+		}
+	}
+
+	if transferID != "" {
+		body, err := getHCBTransferBody(ctx, transferID)
+		if err != nil {
+			detail.HCBError = err.Error()
+		} else {
+			detail.HCBTransfer = body
+		}
+	}
+	return detail, nil
+}
+
+// paginate returns the page'th page (from 1) of entries and the page count.
+func paginate(entries []DisbursementEntry, page, perPage int) ([]DisbursementEntry, int) {
+	pages := (len(entries) + perPage - 1) / perPage
+	start := (page - 1) * perPage
+	if start >= len(entries) {
+		return []DisbursementEntry{}, pages
+	}
+	end := start + perPage
+	if end > len(entries) {
+		end = len(entries)
+	}
+	return entries[start:end], pages
+}
+
+// parsePage reads the page and per_page query parameters.
+func parsePage(get func(string) string) (page, perPage int, err error) {
+	page, perPage = 1, historyPageSize
+	if raw := get("page"); raw != "" {
+		if page, err = strconv.Atoi(raw); err != nil || page < 1 {
+			return 0, 0, fmt.Errorf("page %q must be a positive number", raw)
+		}
+	}
+	if raw := get("per_page"); raw != "" {
+		if perPage, err = strconv.Atoi(raw); err != nil || perPage < 1 || perPage > historyMaxPageSize {
+			return 0, 0, fmt.Errorf("per_page %q must be between 1 and %d", raw, historyMaxPageSize)
+		}
+	}
+	return page, perPage, nil
+}
+
+func getDisbursementRecord(ctx context.Context, recordID string) (*AirtableDisbursementResponse, error) {
+	u := fmt.Sprintf("https://api.airtable.com/v0/%s/disbursements/%s", os.Getenv("AIRTABLE_BASE_ID"), url.PathEscape(recordID))
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("AIRTABLE_API_KEY"))
+
+	resp, err := airtableClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("disbursement %s %w", recordID, errNotFound)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("airtable API error: %s", string(body))
+	}
+
+	var record AirtableDisbursementResponse
+	if err := json.Unmarshal(body, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
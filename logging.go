@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Logs are JSON lines on stderr. LOG_LEVEL selects debug, info (default),
+// warn or error. Correlation fields (run_id, event_record_id, hcb_event_id,
+// disbursement_id, user) are attached to a context with withLogAttrs and
+// added to every line logged with that context.
+
+type logAttrsKey struct{}
+
+// withLogAttrs returns a context whose log lines also carry args, given as
+// alternating keys and values like slog.Info.
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	parent, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	attrs := append([]slog.Attr{}, parent...)
+	for len(args) >= 2 {
+		key, _ := args[0].(string)
+		attrs = append(attrs, slog.Any(key, args[1]))
+		args = args[2:]
+	}
+	return context.WithValue(ctx, logAttrsKey{}, attrs)
+}
+
+// contextHandler adds the correlation attributes stored in the context, and
+// the current trace and span IDs, to each record before passing it on.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func setupLogging() {
+	level := slog.LevelInfo
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+
+	secrets := secretValues()
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			return redactAttr(a, secrets)
+		},
+	})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// sensitiveKeys are attribute names whose values are never logged, on their
+// own or as the last word of a key (hcb_api_token, webhook_secret). Keys that
+// merely mention them, like token_id, are logged.
+var sensitiveKeys = []string{"token", "secret", "password", "api_key", "apikey", "authorization"}
+
+// secretValues collects configured credentials so they can be scrubbed from
+// messages and error strings, e.g. an upstream error body echoing a header.
+func secretValues() []string {
+	var secrets []string
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if len(value) < 6 {
+			continue
+		}
+		upper := strings.ToUpper(name)
+		if strings.HasSuffix(upper, "_KEY") || strings.HasSuffix(upper, "_TOKEN") || strings.HasSuffix(upper, "_SECRET") ||
+			strings.HasSuffix(upper, "_PASSWORD") || upper == "SLACK_WEBHOOK_URL" {
+			secrets = append(secrets, value)
+		}
+	}
+	return secrets
+}
+
+func redactAttr(a slog.Attr, secrets []string) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, sensitive := range sensitiveKeys {
+		if key == sensitive || strings.HasSuffix(key, "_"+sensitive) {
+			return slog.String(a.Key, "[REDACTED]")
+		}
+	}
+
+	var s string
+	switch v := a.Value.Any().(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	default:
+		return a
+	}
+	redacted := redactString(s, secrets)
+	if redacted == s && a.Value.Kind() == slog.KindString {
+		return a
+	}
+	return slog.String(a.Key, redacted)
+}
+
+func redactString(s string, secrets []string) string {
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, "[REDACTED]")
+	}
+	return s
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestRedactAttrKeys(t *testing.T) {
+	tests := []struct {
+		key      string
+		redacted bool
+	}{
+		{"token", true},
+		{"hcb_api_token", true},
+		{"webhook_secret", true},
+		{"Authorization", true},
+		{"api_key", true},
+		{"token_id", false},
+		{"token_name", false},
+		{"record_id", false},
+	}
+	for _, tt := range tests {
+		got := redactAttr(slog.String(tt.key, "value"), nil).Value.String()
+		if (got == "[REDACTED]") != tt.redacted {
+			t.Errorf("%s logged as %q, want redacted %v", tt.key, got, tt.redacted)
+		}
+	}
+}
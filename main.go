@@ -2,18 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
-	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type AirtableEvent struct {
@@ -41,7 +48,8 @@ type AirtableDisbursement struct {
 }
 
 type AirtableDisbursementResponse struct {
-	ID     string `json:"id"`
+	ID          string    `json:"id"`
+	CreatedTime time.Time `json:"createdTime"`
 	Fields struct {
 		DisbursementID   int     `json:"disbursement_id"`
 		AssociatedEvent  []string `json:"associated_event"`
@@ -49,6 +57,8 @@ type AirtableDisbursementResponse struct {
 		Status           string   `json:"status"`
 		DisbursementType string   `json:"disbursement_type"`
 		Notes            string   `json:"notes"`
+		HCBTransferID     string  `json:"hcb_transfer_id"`
+		HCBTransferStatus string  `json:"hcb_transfer_status"`
 	} `json:"fields"`
 }
 
@@ -58,6 +68,13 @@ type HCBTransferRequest struct {
 	AmountCents      int    `json:"amount_cents"`
 }
 
+// HCBTransferResponse is the part of HCB's transfer response we keep.
+type HCBTransferResponse struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	AmountCents int    `json:"amount_cents"`
+}
+
 type DisbursementStats struct {
 	TotalEvents       int
 	EventsWithAmount  int
@@ -70,6 +87,9 @@ type DisbursementStats struct {
 
 var stats DisbursementStats
 
+// eventsViewID is the Airtable view of events that runs disburse to.
+const eventsViewID = "viwjvoyfA2Cgc4XE4"
+
 const dashboardHTML = `<!DOCTYPE html>
 <html>
 <head>
@@ -133,6 +153,11 @@ const dashboardHTML = `<!DOCTYPE html>
         .badge-withdrawal { background: #fce4ec; color: #c62828; }
         .amount-positive { color: #2e7d32; font-weight: 600; }
         .amount-negative { color: #c62828; font-weight: 600; }
+        .event-table tr.excluded td { color: #aaa; }
+        .event-table tr.excluded td.amount-positive, .event-table tr.excluded td.amount-negative { text-decoration: line-through; }
+        .reason-input { display: none; width: 100%%; margin-top: 6px; padding: 6px 8px; border: 1.5px solid #ddd; border-radius: 6px; font-size: 12px; }
+        .reason-input.missing { border-color: #c62828; }
+        tr.excluded .reason-input { display: block; }
 
         /* Spinner */
         .spinner { display: inline-block; width: 18px; height: 18px; border: 2.5px solid rgba(255,255,255,0.3); border-top-color: #fff; border-radius: 50%%; animation: spin 0.6s linear infinite; }
@@ -150,7 +175,7 @@ const dashboardHTML = `<!DOCTYPE html>
 <body>
     <div class="container">
         <h1>💸 Cash Cannon</h1>
-        <p class="subtitle">Campfire disbursement dashboard</p>
+        <p class="subtitle">Campfire disbursement dashboard · <a href="/history" style="color:#007cba;">Disbursement history</a> · <a href="/tokens" style="color:#007cba;">API tokens</a></p>
 
         <div id="resultBanner" class="result-banner"></div>
 
@@ -167,6 +192,18 @@ const dashboardHTML = `<!DOCTYPE html>
             <p style="font-size:12px;color:#999;margin-top:12px;">Last run: %s</p>
         </div>
 
+        <div class="card" id="approvalsCard" style="display:none;">
+            <h2>Awaiting Approval</h2>
+            <p style="font-size:13px;color:#666;margin-bottom:16px;">Scheduled autogrant plans that were not sent automatically. Balances are re-checked on approval.</p>
+            <div id="approvalsList"></div>
+        </div>
+
+        <div class="card" id="interruptedCard" style="display:none;">
+            <h2>Interrupted Runs</h2>
+            <p style="font-size:13px;color:#666;margin-bottom:16px;">Runs stopped by a shutdown. Resuming continues with the first event that was not sent.</p>
+            <div id="interruptedList"></div>
+        </div>
+
         <div class="card">
             <h2>Autogrant Disbursements</h2>
             <p style="font-size:13px;color:#666;margin-bottom:16px;">Disburse the <code>amount_owed</code> to each event. Only events with a non-zero balance will be processed.</p>
@@ -179,17 +216,54 @@ const dashboardHTML = `<!DOCTYPE html>
 
         <div class="card">
             <h2>Custom Miscellaneous Disbursements</h2>
-            <p style="font-size:13px;color:#666;margin-bottom:16px;">Send a fixed dollar amount to every event in the view.</p>
+            <p style="font-size:13px;color:#666;margin-bottom:16px;">Send a fixed dollar amount to every event in the view, or only to the events a filter selects. A clawback pulls the amount back from each event to Campfire.</p>
             <div class="custom-input">
+                <label for="customDirection">Direction</label>
+                <select id="customDirection" style="padding:10px 14px;border:1.5px solid #ddd;border-radius:8px;font-size:15px;">
+                    <option value="grant">Send to events</option>
+                    <option value="clawback">Claw back from events</option>
+                </select>
                 <label for="customAmount">Amount per event ($)</label>
                 <input type="number" id="customAmount" step="0.01" min="0.01" placeholder="0.00">
             </div>
+            <div class="custom-input">
+                <label for="targetKind">Send to</label>
+                <select id="targetKind" onchange="updateTargetInput()" style="padding:10px 14px;border:1.5px solid #ddd;border-radius:8px;font-size:15px;">
+                    <option value="">Every event in the view</option>
+                    <option value="formula">Events matching an Airtable formula</option>
+                    <option value="view">Every event in another view</option>
+                    <option value="record_ids">Selected records</option>
+                </select>
+                <input type="text" id="targetValue" style="display:none;width:320px;">
+            </div>
+            <div class="custom-input">
+                <label for="customMemo">Memo</label>
+                <input type="text" id="customMemo" maxlength="200" placeholder="Optional, e.g. Hackathon prize" style="width:320px;">
+            </div>
             <div class="actions">
                 <button class="btn btn-danger" onclick="previewDisbursements('custom')">
                     Preview &amp; Disburse
                 </button>
             </div>
         </div>
+
+        <div class="card">
+            <h2>Per-Event Amounts</h2>
+            <p style="font-size:13px;color:#666;margin-bottom:16px;">Upload a CSV or JSON file with <code>hcb_event_id</code> or <code>record_id</code>, <code>amount</code> and an optional <code>memo</code> per row. Every row is checked against the events view before anything is sent.</p>
+            <div class="custom-input">
+                <label for="uploadFile">File</label>
+                <input type="file" id="uploadFile" accept=".csv,.json,text/csv,application/json" style="width:auto;">
+            </div>
+            <div class="custom-input">
+                <label for="uploadMemo">Memo</label>
+                <input type="text" id="uploadMemo" maxlength="200" placeholder="Optional, for rows without a memo" style="width:320px;">
+            </div>
+            <div class="actions">
+                <button class="btn btn-danger" onclick="previewDisbursements('upload')">
+                    Preview &amp; Disburse
+                </button>
+            </div>
+        </div>
     </div>
 
     <!-- Confirmation Modal -->
@@ -214,6 +288,10 @@ const dashboardHTML = `<!DOCTYPE html>
     <script>
     let currentMode = '';
     let currentCustomAmount = 0;
+    let currentTarget = '';
+    let currentMemo = '';
+    let currentUpload = null;
+    let currentEvents = [];
 
     function previewDisbursements(mode) {
         currentMode = mode;
@@ -222,59 +300,183 @@ const dashboardHTML = `<!DOCTYPE html>
         document.getElementById('modalBody').innerHTML = '<div style="text-align:center;padding:40px;"><div class="spinner dark"></div><p style="margin-top:12px;color:#888;font-size:13px;">Fetching events from Airtable…</p></div>';
 
         let url = '/api/preview';
-        if (mode === 'custom') {
+        let options = {};
+        if (mode === 'upload') {
+            const file = document.getElementById('uploadFile').files[0];
+            if (!file) {
+                document.getElementById('modalBody').innerHTML = '<p style="color:#c62828;padding:20px;">Please choose a CSV or JSON file.</p>';
+                return;
+            }
+            currentUpload = file;
+            currentMemo = document.getElementById('uploadMemo').value.trim();
+            url += '/upload';
+            options = { method: 'POST', body: uploadForm() };
+            document.getElementById('modalTitle').textContent = 'Confirm Uploaded Disbursements';
+        } else if (mode === 'custom') {
             const amt = document.getElementById('customAmount').value;
             if (!amt || parseFloat(amt) <= 0) {
                 document.getElementById('modalBody').innerHTML = '<p style="color:#c62828;padding:20px;">Please enter a valid amount greater than zero.</p>';
                 return;
             }
             currentCustomAmount = parseFloat(amt);
-            url += '?custom_amount=' + encodeURIComponent(amt);
-            document.getElementById('modalTitle').textContent = 'Confirm Custom Disbursements';
+            if (document.getElementById('customDirection').value === 'clawback') {
+                currentCustomAmount = -currentCustomAmount;
+            }
+            currentTarget = targetParams();
+            currentMemo = document.getElementById('customMemo').value.trim();
+            url += '?custom_amount=' + encodeURIComponent(currentCustomAmount) + currentTarget + '&memo=' + encodeURIComponent(currentMemo);
+            document.getElementById('modalTitle').textContent = currentCustomAmount < 0 ? 'Confirm Custom Clawbacks' : 'Confirm Custom Disbursements';
         } else {
             document.getElementById('modalTitle').textContent = 'Confirm Autogrant Disbursements';
         }
 
-        fetch(url)
+        fetch(url, options)
             .then(r => r.json())
             .then(data => {
+                if (data.problems) {
+                    document.getElementById('modalBody').innerHTML = '<p style="color:#c62828;padding:20px 20px 8px;">Error: ' + escapeHTML(data.error) + '</p>'
+                        + '<ul style="color:#c62828;font-size:13px;padding:0 20px 20px 40px;">' + data.problems.map(p => '<li>' + escapeHTML(p) + '</li>').join('') + '</ul>';
+                    return;
+                }
                 if (data.error) { throw new Error(data.error); }
                 renderPreview(data);
             })
             .catch(err => {
-                document.getElementById('modalBody').innerHTML = '<p style="color:#c62828;padding:20px;">Error: ' + err.message + '</p>';
+                document.getElementById('modalBody').innerHTML = '<p style="color:#c62828;padding:20px;">Error: ' + escapeHTML(err.message) + '</p>';
             });
     }
 
+    const targetPlaceholders = {
+        formula: "e.g. AND({region} = 'EU', {attendees} >= 50)",
+        view: 'viw… view ID',
+        record_ids: 'rec…, rec…'
+    };
+
+    function updateTargetInput() {
+        const kind = document.getElementById('targetKind').value;
+        const input = document.getElementById('targetValue');
+        input.style.display = kind ? 'inline-block' : 'none';
+        input.placeholder = targetPlaceholders[kind] || '';
+    }
+
+    // targetParams encodes the custom target as extra query or form fields.
+    function targetParams() {
+        const kind = document.getElementById('targetKind').value;
+        const value = document.getElementById('targetValue').value.trim();
+        return kind && value ? '&' + kind + '=' + encodeURIComponent(value) : '';
+    }
+
+    function uploadForm() {
+        const form = new FormData();
+        form.append('file', currentUpload);
+        form.append('memo', currentMemo);
+        return form;
+    }
+
+    // escapeHTML is for everything that comes from Airtable or HCB: event IDs,
+    // organization names, memos and validation reasons can all contain markup
+    function escapeHTML(text) {
+        return String(text).replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;')
+            .replace(/"/g, '&quot;').replace(/'/g, '&#39;');
+    }
+
     function renderPreview(data) {
+        // Blocked events were left out by the validation pass; warnings stay in the plan
+        const blocked = (data.exclusions || []).filter(e => e.excluded_by === 'validation');
+        const orgs = data.organizations || {};
+        const warnings = {};
+        (data.checks || []).filter(c => c.level === 'warning').forEach(c => { warnings[c.record_id] = c.reasons; });
+        let blockedHtml = '';
+        if (blocked.length) {
+            blockedHtml = '<div style="background:#fff3e0;color:#e65100;border-radius:10px;padding:14px 18px;margin-top:16px;font-size:13px;">'
+                + '<strong>' + blocked.length + ' blocked ' + (blocked.length === 1 ? 'event' : 'events') + ' will not be sent.</strong> Fix the event data in Airtable to include them.'
+                + '<ul style="margin:8px 0 0 18px;">' + blocked.map(e => '<li><code>' + escapeHTML(e.hcb_event_id || e.record_id) + '</code> $' + Math.abs(e.amount).toFixed(2)
+                + ': ' + escapeHTML(e.reason.replace(/^blocked: /, '')) + '</li>').join('') + '</ul></div>';
+        }
+
         if (data.event_count === 0) {
-            document.getElementById('modalBody').innerHTML = '<p style="padding:20px;color:#666;">No events to process. All balances are zero.</p>';
+            document.getElementById('modalBody').innerHTML = blocked.length
+                ? '<div style="padding:20px;"><p style="color:#666;">No events can be sent.</p>' + blockedHtml + '</div>'
+                : '<p style="padding:20px;color:#666;">No events to process. All balances are zero.</p>';
             return;
         }
 
-        const totalAbs = data.events.reduce((s, e) => s + Math.abs(e.amount), 0);
-        const grants = data.events.filter(e => e.direction === 'grant');
-        const withdrawals = data.events.filter(e => e.direction === 'withdrawal');
+        currentEvents = data.events;
 
-        let html = '<div class="preview-summary">';
-        html += '<div class="item"><div class="num">' + data.event_count + '</div><div class="lbl">Events</div></div>';
-        html += '<div class="item total"><div class="num">$' + totalAbs.toFixed(2) + '</div><div class="lbl">Total Amount</div></div>';
-        if (grants.length) html += '<div class="item"><div class="num">' + grants.length + '</div><div class="lbl">Grants</div></div>';
-        if (withdrawals.length) html += '<div class="item warn"><div class="num">' + withdrawals.length + '</div><div class="lbl">Withdrawals</div></div>';
-        html += '</div>';
-
-        html += '<table class="event-table"><thead><tr><th>HCB Event ID</th><th>Amount</th><th>Type</th></tr></thead><tbody>';
-        data.events.forEach(e => {
+        let html = '<div class="preview-summary" id="previewSummary"></div>';
+        html += '<table class="event-table"><thead><tr><th></th><th>HCB Event ID</th><th>Amount</th><th>Type</th></tr></thead><tbody>';
+        data.events.forEach((e, i) => {
             const amtClass = e.amount >= 0 ? 'amount-positive' : 'amount-negative';
             const badge = e.direction === 'grant'
                 ? '<span class="badge badge-grant">Grant</span>'
-                : '<span class="badge badge-withdrawal">Withdrawal</span>';
-            html += '<tr><td>' + e.hcb_event_id + '</td><td class="' + amtClass + '">$' + Math.abs(e.amount).toFixed(2) + '</td><td>' + badge + '</td></tr>';
+                : '<span class="badge badge-withdrawal">' + (currentMode === 'autogrant' ? 'Withdrawal' : 'Clawback') + '</span>';
+            html += '<tr id="eventRow' + i + '"><td><input type="checkbox" id="include' + i + '" checked onchange="toggleEvent(' + i + ')"></td>'
+                + '<td>' + escapeHTML(e.hcb_event_id) + (orgs[e.hcb_event_id] ? ' <span style="color:#888;">' + escapeHTML(orgs[e.hcb_event_id]) + '</span>' : '')
+                + (e.memo ? '<div style="font-size:11px;color:#888;">' + escapeHTML(e.memo) + '</div>' : '')
+                + (warnings[e.record_id] ? '<div style="font-size:11px;color:#e65100;">⚠ ' + escapeHTML(warnings[e.record_id].join('; ')) + '</div>' : '')
+                + '<input type="text" class="reason-input" id="reason' + i + '" placeholder="Reason for excluding (required)" oninput="updateSelection()"></td>'
+                + '<td class="' + amtClass + '">$' + Math.abs(e.amount).toFixed(2) + '</td><td>' + badge + '</td></tr>';
         });
-        html += '</tbody></table>';
+        html += '</tbody></table>' + blockedHtml;
+
+        if (currentMode !== 'autogrant' && data.events.some(e => e.amount < 0)) {
+            html += '<div id="clawbackWarning" style="background:#fce4ec;color:#b71c1c;border-radius:10px;padding:14px 18px;margin-top:16px;font-size:13px;">'
+                + '<strong>This run claws money back.</strong> <span id="clawbackSummary"></span> will be pulled from the events to Campfire.'
+                + '<div style="margin-top:10px;"><label for="clawbackConfirm">Type <code>CLAWBACK</code> to confirm:</label> '
+                + '<input type="text" id="clawbackConfirm" oninput="updateSelection()" style="padding:6px 8px;border:1.5px solid #e57373;border-radius:6px;"></div></div>';
+        }
 
         document.getElementById('modalBody').innerHTML = html;
         document.getElementById('modalFooter').style.display = 'flex';
+        updateSelection();
+    }
+
+    function toggleEvent(i) {
+        const included = document.getElementById('include' + i).checked;
+        document.getElementById('eventRow' + i).classList.toggle('excluded', !included);
+        if (!included) document.getElementById('reason' + i).focus();
+        updateSelection();
+    }
+
+    // selectedEvents splits the previewed events by their checkbox.
+    function selectedEvents() {
+        const included = [], excluded = [];
+        currentEvents.forEach((e, i) => {
+            if (document.getElementById('include' + i).checked) {
+                included.push(e);
+            } else {
+                excluded.push({ record_id: e.record_id, reason: document.getElementById('reason' + i).value.trim() });
+            }
+        });
+        return { included, excluded };
+    }
+
+    function updateSelection() {
+        const { included, excluded } = selectedEvents();
+        const totalAbs = included.reduce((s, e) => s + Math.abs(e.amount), 0);
+        const grants = included.filter(e => e.direction === 'grant');
+        const withdrawals = included.filter(e => e.direction === 'withdrawal');
+
+        let html = '<div class="item"><div class="num">' + included.length + '</div><div class="lbl">Events</div></div>';
+        html += '<div class="item total"><div class="num">$' + totalAbs.toFixed(2) + '</div><div class="lbl">Total Amount</div></div>';
+        if (grants.length) html += '<div class="item"><div class="num">' + grants.length + '</div><div class="lbl">Grants</div></div>';
+        if (withdrawals.length) html += '<div class="item warn"><div class="num">' + withdrawals.length + '</div><div class="lbl">' + (currentMode === 'autogrant' ? 'Withdrawals' : 'Clawbacks') + '</div></div>';
+        if (excluded.length) html += '<div class="item"><div class="num">' + excluded.length + '</div><div class="lbl">Excluded</div></div>';
+        document.getElementById('previewSummary').innerHTML = html;
+
+        currentEvents.forEach((e, i) => {
+            const reason = document.getElementById('reason' + i);
+            reason.classList.toggle('missing', !document.getElementById('include' + i).checked && reason.value.trim() === '');
+        });
+        const missingReason = excluded.some(e => e.reason === '');
+        let clawbackUnconfirmed = false;
+        if (document.getElementById('clawbackWarning')) {
+            const clawbacks = included.filter(e => e.amount < 0);
+            const total = clawbacks.reduce((s, e) => s - e.amount, 0);
+            document.getElementById('clawbackSummary').textContent = '$' + total.toFixed(2) + ' from ' + clawbacks.length + ' events';
+            clawbackUnconfirmed = clawbacks.length > 0 && document.getElementById('clawbackConfirm').value.trim() !== 'CLAWBACK';
+        }
+        document.getElementById('confirmBtn').disabled = included.length === 0 || missingReason || clawbackUnconfirmed;
     }
 
     function executeDisbursements() {
@@ -282,20 +484,35 @@ const dashboardHTML = `<!DOCTYPE html>
         btn.disabled = true;
         btn.innerHTML = '<span class="spinner"></span> Processing…';
 
-        let url, body;
-        if (currentMode === 'custom') {
-            url = '/trigger-custom-disbursements';
-            body = 'custom_amount=' + encodeURIComponent(currentCustomAmount);
+        const { included, excluded } = selectedEvents();
+        const exclusions = JSON.stringify(excluded);
+        const expected = JSON.stringify(included.map(e => ({ record_id: e.record_id, amount: e.amount })));
+        const clawbackConfirmed = document.getElementById('clawbackWarning') ? 'true' : '';
+        let request;
+        if (currentMode === 'upload') {
+            const form = uploadForm();
+            form.append('exclusions', exclusions);
+            form.append('expected', expected);
+            form.append('confirm_clawback', clawbackConfirmed);
+            request = fetch('/trigger-upload-disbursements', { method: 'POST', body: form });
         } else {
-            url = '/trigger-disbursements';
-            body = '';
+            let url, body;
+            if (currentMode === 'custom') {
+                url = '/trigger-custom-disbursements';
+                body = 'custom_amount=' + encodeURIComponent(currentCustomAmount) + currentTarget + '&memo=' + encodeURIComponent(currentMemo) + '&';
+            } else {
+                url = '/trigger-disbursements';
+                body = '';
+            }
+            body += 'exclusions=' + encodeURIComponent(exclusions) + '&expected=' + encodeURIComponent(expected) + '&confirm_clawback=' + clawbackConfirmed;
+            request = fetch(url, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+                body: body
+            });
         }
 
-        fetch(url, {
-            method: 'POST',
-            headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
-            body: body
-        })
+        request
         .then(r => r.json())
         .then(result => {
             closeModal();
@@ -311,7 +528,7 @@ const dashboardHTML = `<!DOCTYPE html>
         const banner = document.getElementById('resultBanner');
         if (result.error) {
             banner.className = 'result-banner error';
-            banner.innerHTML = '<h3>Disbursement Failed</h3><p>' + result.error + '</p>';
+            banner.innerHTML = '<h3>Disbursement Failed</h3><p>' + escapeHTML(result.error) + '</p>';
         } else {
             banner.className = 'result-banner success';
             banner.innerHTML = '<h3>Disbursements Complete</h3>'
@@ -320,229 +537,1288 @@ const dashboardHTML = `<!DOCTYPE html>
         setTimeout(() => { location.reload(); }, 3000);
     }
 
-    function closeModal() {
-        document.getElementById('confirmModal').classList.remove('active');
-        const btn = document.getElementById('confirmBtn');
-        btn.disabled = false;
-        btn.innerHTML = 'Confirm &amp; Send Money';
-    }
-    </script>
-</body>
-</html>`
+    function loadApprovals() {
+        fetch('/api/runs?status=awaiting_approval')
+            .then(r => r.json())
+            .then(data => {
+                if (!data.runs || data.runs.length === 0) return;
+                let html = '<table class="event-table"><thead><tr><th>Planned</th><th>Events</th><th>Total</th><th>Held because</th><th></th></tr></thead><tbody>';
+                data.runs.forEach(run => {
+                    html += '<tr><td>' + new Date(run.created_at).toLocaleString() + '</td>'
+                        + '<td>' + run.plan.event_count + '</td>'
+                        + '<td>$' + run.plan.total_amount.toFixed(2) + '</td>'
+                        + '<td>' + (run.policy_violations || ['auto-execute disabled']).map(escapeHTML).join('<br>') + '</td>'
+                        + '<td style="white-space:nowrap;"><button class="btn btn-primary" onclick="decideRun(this, \'' + run.id + '\', \'approve\')">Approve</button> '
+                        + '<button class="btn btn-ghost" onclick="decideRun(this, \'' + run.id + '\', \'reject\')">Reject</button></td></tr>';
+                });
+                html += '</tbody></table>';
+                document.getElementById('approvalsList').innerHTML = html;
+                document.getElementById('approvalsCard').style.display = 'block';
+            });
+    }
+
+    // decideRun disables the row's buttons once clicked so a run is never
+    // approved or resumed twice; the server refuses a second claim anyway.
+    function decideRun(btn, id, decision) {
+        if (decision === 'approve' && !confirm('Send this scheduled autogrant plan now?')) return;
+        if (decision === 'resume' && !confirm('Resume this run and send the remaining disbursements?')) return;
+        const buttons = btn.closest('tr').querySelectorAll('button');
+        buttons.forEach(b => b.disabled = true);
+        fetch('/api/runs/' + id + '/' + decision, { method: 'POST' })
+            .then(r => r.json())
+            .then(result => {
+                if (decision === 'reject' && !result.error) { location.reload(); return; }
+                showResult(result);
+            })
+            .catch(err => {
+                buttons.forEach(b => b.disabled = false);
+                showResult({ error: err.message });
+            });
+    }
+
+    function loadInterrupted() {
+        fetch('/api/runs?status=interrupted')
+            .then(r => r.json())
+            .then(data => {
+                if (!data.runs || data.runs.length === 0) return;
+                let html = '<table class="event-table"><thead><tr><th>Run</th><th>Mode</th><th>Done</th><th>Remaining</th><th></th></tr></thead><tbody>';
+                data.runs.forEach(run => {
+                    const done = (run.results || []).filter(r => r.status).length;
+                    html += '<tr><td>' + run.id + '</td><td>' + run.mode + '</td>'
+                        + '<td>' + done + '</td><td>' + (run.plan.event_count - done) + '</td>'
+                        + '<td><button class="btn btn-primary" onclick="decideRun(this, \'' + run.id + '\', \'resume\')">Resume</button></td></tr>';
+                });
+                html += '</tbody></table>';
+                document.getElementById('interruptedList').innerHTML = html;
+                document.getElementById('interruptedCard').style.display = 'block';
+            });
+    }
+
+    loadApprovals();
+    loadInterrupted();
+
+    function closeModal() {
+        document.getElementById('confirmModal').classList.remove('active');
+        const btn = document.getElementById('confirmBtn');
+        btn.disabled = false;
+        btn.innerHTML = 'Confirm &amp; Send Money';
+    }
+    </script>
+</body>
+</html>`
+
+const historyHTML = `<!DOCTYPE html>
+<html>
+<head>
+    <title>Disbursement History - Campfire Cash Cannon</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <style>
+        * { box-sizing: border-box; margin: 0; padding: 0; }
+        body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; background: #f0f2f5; color: #1a1a2e; min-height: 100vh; }
+        .container { max-width: 1100px; margin: 0 auto; padding: 32px 20px; }
+        h1 { font-size: 28px; font-weight: 700; margin-bottom: 4px; }
+        .subtitle { color: #666; font-size: 14px; margin-bottom: 28px; }
+        .subtitle a { color: #007cba; }
+        .card { background: #fff; border-radius: 12px; padding: 24px; margin-bottom: 20px; box-shadow: 0 1px 3px rgba(0,0,0,0.08); }
+        .filters { display: flex; gap: 12px; flex-wrap: wrap; align-items: flex-end; }
+        .filters label { display: block; font-size: 12px; font-weight: 600; color: #555; margin-bottom: 4px; }
+        .filters input, .filters select { padding: 8px 10px; border: 1.5px solid #ddd; border-radius: 8px; font-size: 14px; }
+        .btn { padding: 9px 18px; border: none; border-radius: 8px; font-size: 14px; font-weight: 600; cursor: pointer; }
+        .btn:disabled { opacity: 0.5; cursor: not-allowed; }
+        .btn-primary { background: #007cba; color: #fff; }
+        .btn-ghost { background: #e8e8e8; color: #333; }
+        .event-table { width: 100%; border-collapse: collapse; font-size: 13px; }
+        .event-table th { text-align: left; padding: 8px 12px; background: #f4f4f4; font-weight: 600; color: #555; font-size: 11px; text-transform: uppercase; letter-spacing: 0.5px; }
+        .event-table td { padding: 8px 12px; border-bottom: 1px solid #f0f0f0; vertical-align: top; }
+        .event-table tbody tr { cursor: pointer; }
+        .event-table tbody tr:hover td { background: #f8f9fa; }
+        .event-table tr.detail td { background: #f8f9fa; cursor: default; }
+        .badge { display: inline-block; padding: 2px 8px; border-radius: 4px; font-size: 11px; font-weight: 600; background: #eee; color: #555; }
+        .badge-processed, .badge-completed { background: #e8f5e9; color: #2e7d32; }
+        .badge-submitted { background: #e3f2fd; color: #1565c0; }
+        .badge-failed, .badge-rejected { background: #fce4ec; color: #c62828; }
+        .badge-unknown { background: #fff3e0; color: #e65100; }
+        .amount-positive { color: #2e7d32; font-weight: 600; }
+        .amount-negative { color: #c62828; font-weight: 600; }
+        .pager { display: flex; justify-content: space-between; align-items: center; margin-top: 16px; font-size: 13px; color: #666; }
+        pre { white-space: pre-wrap; word-break: break-word; font-size: 12px; background: #fff; border: 1px solid #eee; border-radius: 6px; padding: 10px; margin-top: 4px; }
+        dl { display: grid; grid-template-columns: 160px 1fr; gap: 4px 12px; font-size: 12px; }
+        dt { color: #888; }
+        h3 { font-size: 13px; margin: 14px 0 4px; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>Disbursement History</h1>
+        <p class="subtitle">Every disbursement in the run history. <a href="/">Back to the dashboard</a></p>
+
+        <div class="card">
+            <form class="filters" id="filters" onsubmit="search(1); return false;">
+                <div><label for="status">Status</label>
+                    <select id="status">
+                        <option value="">Any</option>
+                        <option value="submitted">Submitted</option>
+                        <option value="completed">Completed</option>
+                        <option value="rejected">Rejected</option>
+                        <option value="processed">Processed (any transfer state)</option>
+                        <option value="failed">Failed</option>
+                        <option value="unknown">Unknown</option>
+                    </select></div>
+                <div><label for="type">Type</label>
+                    <select id="type">
+                        <option value="">Any</option>
+                        <option value="autogrant">Autogrant</option>
+                        <option value="withdrawal">Withdrawal</option>
+                        <option value="miscellaneous">Miscellaneous</option>
+                        <option value="clawback">Clawback</option>
+                    </select></div>
+                <div><label for="event">Event</label><input type="text" id="event" placeholder="hcb_event_id or rec…"></div>
+                <div><label for="operator">Operator</label><input type="text" id="operator"></div>
+                <div><label for="from">From</label><input type="date" id="from"></div>
+                <div><label for="to">To</label><input type="date" id="to"></div>
+                <div><button class="btn btn-primary" type="submit">Search</button></div>
+            </form>
+        </div>
+
+        <div class="card">
+            <p style="font-size:13px;color:#666;margin-bottom:12px;">Export the filtered disbursements:
+                <a href="#" onclick="exportAs('csv'); return false;" style="color:#007cba;">CSV</a> ·
+                <a href="#" onclick="exportAs('json'); return false;" style="color:#007cba;">JSON</a> ·
+                <a href="#" onclick="exportAs('journal'); return false;" style="color:#007cba;">Accounting journal</a></p>
+            <div id="results"><p style="color:#888;font-size:13px;">Loading…</p></div>
+            <div class="pager">
+                <button class="btn btn-ghost" id="prevBtn" onclick="search(currentPage - 1)">&larr; Newer</button>
+                <span id="pageInfo"></span>
+                <button class="btn btn-ghost" id="nextBtn" onclick="search(currentPage + 1)">Older &rarr;</button>
+            </div>
+        </div>
+    </div>
+
+    <script>
+    let currentPage = 1;
+    let currentEntries = [];
+
+    function filterParams() {
+        const params = new URLSearchParams();
+        ['status', 'type', 'event', 'operator', 'from', 'to'].forEach(name => {
+            const value = document.getElementById(name).value.trim();
+            if (value) params.set(name, value);
+        });
+        return params;
+    }
+
+    function search(page) {
+        const params = filterParams();
+        params.set('page', page);
+        history.replaceState(null, '', '?' + params.toString());
+        fetch('/api/disbursements?' + params.toString())
+            .then(r => r.json())
+            .then(data => {
+                if (data.error) throw new Error(data.error);
+                currentPage = data.page;
+                currentEntries = data.disbursements;
+                render(data);
+            })
+            .catch(err => {
+                document.getElementById('results').innerHTML = '<p style="color:#c62828;">Error: ' + escapeHTML(err.message) + '</p>';
+            });
+    }
+
+    function exportAs(format) {
+        const params = filterParams();
+        params.set('format', format);
+        location.href = '/api/export?' + params.toString();
+    }
+
+    // entryStatus shows the transfer state of a processed disbursement.
+    function entryStatus(e) {
+        if (e.status !== 'processed' || !e.hcb_transfer_status) return e.status;
+        const s = e.hcb_transfer_status.toLowerCase();
+        if (['completed', 'deposited', 'fulfilled', 'settled'].includes(s)) return 'completed';
+        if (['rejected', 'canceled', 'cancelled', 'failed', 'declined'].includes(s)) return 'rejected';
+        return 'submitted';
+    }
+
+    function render(data) {
+        if (data.total === 0) {
+            document.getElementById('results').innerHTML = '<p style="color:#888;font-size:13px;">No disbursements match.</p>';
+        } else {
+            let html = '<table class="event-table"><thead><tr><th>Date</th><th>Event</th><th>Type</th><th>Amount</th><th>Status</th><th>Disbursement</th><th>Operator</th><th>Run</th></tr></thead><tbody>';
+            data.disbursements.forEach((e, i) => {
+                const status = entryStatus(e);
+                html += '<tr onclick="toggleDetail(' + i + ')"><td>' + new Date(e.at).toLocaleString() + '</td>'
+                    + '<td><a href="/events/' + encodeURIComponent(e.hcb_event_id) + '" onclick="event.stopPropagation()" style="color:#007cba;">' + escapeHTML(e.hcb_event_id) + '</a></td><td>' + e.disbursement_type + '</td>'
+                    + '<td class="' + (e.amount >= 0 ? 'amount-positive' : 'amount-negative') + '">$' + Math.abs(e.amount).toFixed(2) + '</td>'
+                    + '<td><span class="badge badge-' + status + '">' + status + '</span></td>'
+                    + '<td>' + (e.disbursement_id || '') + '</td><td>' + escapeHTML(e.operator || e.source) + '</td>'
+                    + '<td><code style="font-size:11px;">' + e.run_id + '</code></td></tr>'
+                    + '<tr class="detail" id="detail' + i + '" style="display:none;"><td colspan="8"></td></tr>';
+            });
+            html += '</tbody></table>';
+            document.getElementById('results').innerHTML = html;
+        }
+        document.getElementById('pageInfo').textContent = data.total + ' disbursements, page ' + data.page + ' of ' + Math.max(data.pages, 1);
+        document.getElementById('prevBtn').disabled = data.page <= 1;
+        document.getElementById('nextBtn').disabled = data.page >= data.pages;
+    }
+
+    // Everything from Airtable or HCB can contain markup: event IDs, memos,
+    // notes, and error bodies in HCB responses
+    function escapeHTML(text) {
+        return String(text).replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;')
+            .replace(/"/g, '&quot;').replace(/'/g, '&#39;');
+    }
+
+    function toggleDetail(i) {
+        const row = document.getElementById('detail' + i);
+        if (row.style.display !== 'none') {
+            row.style.display = 'none';
+            return;
+        }
+        row.style.display = '';
+        const e = currentEntries[i];
+        const cell = row.firstChild;
+        let html = '<dl><dt>Event record</dt><dd>' + e.record_id + '</dd>'
+            + '<dt>Disbursement record</dt><dd>' + (e.disbursement_record_id || 'not created') + '</dd>'
+            + '<dt>HCB transfer</dt><dd>' + (e.hcb_transfer_id ? escapeHTML(e.hcb_transfer_id + ' (' + e.hcb_transfer_status + ')') : 'none') + '</dd>'
+            + '<dt>Step</dt><dd>' + (e.step || '') + '</dd>'
+            + (e.memo ? '<dt>Memo</dt><dd>' + escapeHTML(e.memo) + '</dd>' : '')
+            + (e.error ? '<dt>Error</dt><dd style="color:#c62828;">' + escapeHTML(e.error) + '</dd>' : '')
+            + '</dl>';
+        cell.innerHTML = html + (e.disbursement_record_id ? '<p style="color:#888;font-size:12px;margin-top:8px;">Loading notes…</p>' : '');
+        if (!e.disbursement_record_id) return;
+
+        fetch('/api/disbursements/' + encodeURIComponent(e.disbursement_record_id))
+            .then(r => r.json())
+            .then(data => {
+                if (data.error) throw new Error(data.error);
+                html += '<h3>Airtable notes</h3>' + (data.airtable
+                    ? '<pre>' + escapeHTML(data.airtable.fields.notes || '(empty)') + '</pre>'
+                    : '<p style="color:#c62828;font-size:12px;">' + escapeHTML(data.airtable_error) + '</p>');
+                if (data.hcb_transfer) {
+                    html += '<h3>HCB transfer</h3><pre>' + escapeHTML(JSON.stringify(data.hcb_transfer, null, 2)) + '</pre>';
+                } else if (data.hcb_error) {
+                    html += '<h3>HCB transfer</h3><p style="color:#c62828;font-size:12px;">' + escapeHTML(data.hcb_error) + '</p>';
+                }
+                cell.innerHTML = html;
+            })
+            .catch(err => {
+                cell.innerHTML = html + '<p style="color:#c62828;font-size:12px;">Error: ' + escapeHTML(err.message) + '</p>';
+            });
+    }
+
+    // Restore the filters from the URL so a filtered page can be shared
+    const initial = new URLSearchParams(location.search);
+    ['status', 'type', 'event', 'operator', 'from', 'to'].forEach(name => {
+        if (initial.get(name)) document.getElementById(name).value = initial.get(name);
+    });
+    search(parseInt(initial.get('page') || '1', 10));
+    </script>
+</body>
+</html>`
+
+const eventHTML = `<!DOCTYPE html>
+<html>
+<head>
+    <title>Event Funding - Campfire Cash Cannon</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <style>
+        * { box-sizing: border-box; margin: 0; padding: 0; }
+        body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; background: #f0f2f5; color: #1a1a2e; min-height: 100vh; }
+        .container { max-width: 960px; margin: 0 auto; padding: 32px 20px; }
+        h1 { font-size: 28px; font-weight: 700; margin-bottom: 4px; }
+        .subtitle { color: #666; font-size: 14px; margin-bottom: 28px; }
+        .subtitle a { color: #007cba; }
+        .card { background: #fff; border-radius: 12px; padding: 24px; margin-bottom: 20px; box-shadow: 0 1px 3px rgba(0,0,0,0.08); }
+        .card h2 { font-size: 16px; font-weight: 600; margin-bottom: 16px; color: #333; }
+        .stats-grid { display: grid; grid-template-columns: repeat(auto-fit, minmax(140px, 1fr)); gap: 16px; }
+        .stat { text-align: center; }
+        .stat .value { font-size: 24px; font-weight: 700; color: #007cba; }
+        .stat .label { font-size: 12px; color: #888; margin-top: 2px; text-transform: uppercase; letter-spacing: 0.5px; }
+        .event-table { width: 100%; border-collapse: collapse; font-size: 13px; }
+        .event-table th { text-align: left; padding: 8px 12px; background: #f4f4f4; font-weight: 600; color: #555; font-size: 11px; text-transform: uppercase; letter-spacing: 0.5px; }
+        .event-table td { padding: 8px 12px; border-bottom: 1px solid #f0f0f0; vertical-align: top; }
+        .amount-positive { color: #2e7d32; font-weight: 600; }
+        .amount-negative { color: #c62828; font-weight: 600; }
+        .notice { background: #fff3e0; color: #e65100; border-radius: 10px; padding: 12px 16px; margin-bottom: 20px; font-size: 13px; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1 id="title">Event</h1>
+        <p class="subtitle"><span id="orgName"></span> <a href="/history">Disbursement history</a> · <a href="/">Dashboard</a></p>
+        <div id="content"><p style="color:#888;font-size:13px;">Loading…</p></div>
+    </div>
+
+    <script>
+    const hcbEventID = decodeURIComponent(location.pathname.split('/').pop());
+    document.getElementById('title').textContent = hcbEventID;
+
+    function escapeHTML(text) {
+        return String(text).replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;')
+            .replace(/"/g, '&quot;').replace(/'/g, '&#39;');
+    }
+
+    function money(amount) {
+        return '<span class="' + (amount >= 0 ? 'amount-positive' : 'amount-negative') + '">' + (amount < 0 ? '-' : '') + '$' + Math.abs(amount).toFixed(2) + '</span>';
+    }
+
+    function row(e, extra) {
+        return '<tr><td>' + new Date(e.at).toLocaleString() + '</td><td>' + escapeHTML(e.disbursement_type) + '</td><td>' + money(e.amount) + '</td>'
+            + '<td>' + (e.disbursement_id || '') + '</td><td>' + escapeHTML(e.memo || '') + '</td>' + extra + '</tr>';
+    }
+
+    fetch('/api/events/' + encodeURIComponent(hcbEventID) + '/timeline')
+        .then(r => r.json())
+        .then(data => {
+            if (data.error) throw new Error(data.error);
+            if (data.organization) document.getElementById('orgName').textContent = data.organization + ' ·';
+
+            let html = (data.errors || []).map(e => '<div class="notice">' + escapeHTML(e) + '</div>').join('');
+            html += '<div class="card"><div class="stats-grid">'
+                + '<div class="stat"><div class="value">' + money(data.net) + '</div><div class="label">Net received</div></div>'
+                + '<div class="stat"><div class="value">' + (data.amount_owed === null ? '–' : money(data.amount_owed)) + '</div><div class="label">Amount owed now</div></div>';
+            ['autogrant', 'withdrawal', 'miscellaneous', 'clawback'].forEach(type => {
+                if (data.totals[type]) html += '<div class="stat"><div class="value">' + money(data.totals[type]) + '</div><div class="label">' + type + '</div></div>';
+            });
+            html += '<div class="stat"><div class="value">' + data.failed.length + '</div><div class="label">Failed attempts</div></div></div>';
+            if (data.amount_owed === null && !(data.errors || []).length) {
+                html += '<p style="font-size:12px;color:#999;margin-top:12px;">This event is not in the events view.</p>';
+            }
+            html += '</div>';
+
+            html += '<div class="card"><h2>Timeline</h2>';
+            if (data.entries.length === 0) {
+                html += '<p style="color:#888;font-size:13px;">Nothing has been sent to this event yet.</p>';
+            } else {
+                html += '<table class="event-table"><thead><tr><th>Date</th><th>Type</th><th>Amount</th><th>Disbursement</th><th>Memo</th><th>Transfer</th><th>Net</th></tr></thead><tbody>';
+                data.entries.slice().reverse().forEach(e => {
+                    html += row(e, '<td>' + escapeHTML(e.hcb_transfer_status || '') + '</td><td>' + money(e.net) + '</td>');
+                });
+                html += '</tbody></table>';
+            }
+            html += '</div>';
+
+            if (data.failed.length) {
+                html += '<div class="card"><h2>Failed Attempts</h2><table class="event-table"><thead><tr><th>Date</th><th>Type</th><th>Amount</th><th>Disbursement</th><th>Memo</th><th>Status</th><th>Error</th></tr></thead><tbody>';
+                data.failed.slice().reverse().forEach(e => {
+                    const status = e.status === 'processed' ? 'rejected by HCB' : e.status;
+                    html += row(e, '<td>' + escapeHTML(status) + '</td><td style="color:#c62828;">' + escapeHTML(e.error || '') + '</td>');
+                });
+                html += '</tbody></table></div>';
+            }
+            document.getElementById('content').innerHTML = html;
+        })
+        .catch(err => {
+            document.getElementById('content').innerHTML = '<p style="color:#c62828;">Error: ' + escapeHTML(err.message) + '</p>';
+        });
+    </script>
+</body>
+</html>`
+
+const tokensHTML = `<!DOCTYPE html>
+<html>
+<head>
+    <title>API Tokens - Campfire Cash Cannon</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <style>
+        * { box-sizing: border-box; margin: 0; padding: 0; }
+        body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; background: #f0f2f5; color: #1a1a2e; min-height: 100vh; }
+        .container { max-width: 1100px; margin: 0 auto; padding: 32px 20px; }
+        h1 { font-size: 28px; font-weight: 700; margin-bottom: 4px; }
+        .subtitle { color: #666; font-size: 14px; margin-bottom: 28px; }
+        .subtitle a { color: #007cba; }
+        .card { background: #fff; border-radius: 12px; padding: 24px; margin-bottom: 20px; box-shadow: 0 1px 3px rgba(0,0,0,0.08); }
+        .card h2 { font-size: 16px; font-weight: 600; margin-bottom: 16px; color: #333; }
+        .filters { display: flex; gap: 12px; flex-wrap: wrap; align-items: flex-end; }
+        .filters label { display: block; font-size: 12px; font-weight: 600; color: #555; margin-bottom: 4px; }
+        .filters input, .filters select { padding: 8px 10px; border: 1.5px solid #ddd; border-radius: 8px; font-size: 14px; }
+        .btn { padding: 9px 18px; border: none; border-radius: 8px; font-size: 14px; font-weight: 600; cursor: pointer; }
+        .btn:disabled { opacity: 0.5; cursor: not-allowed; }
+        .btn-primary { background: #007cba; color: #fff; }
+        .btn-danger { background: #fce4ec; color: #c62828; padding: 5px 12px; font-size: 12px; }
+        .event-table { width: 100%; border-collapse: collapse; font-size: 13px; }
+        .event-table th { text-align: left; padding: 8px 12px; background: #f4f4f4; font-weight: 600; color: #555; font-size: 11px; text-transform: uppercase; letter-spacing: 0.5px; }
+        .event-table td { padding: 8px 12px; border-bottom: 1px solid #f0f0f0; vertical-align: top; }
+        .badge { display: inline-block; padding: 2px 8px; border-radius: 4px; font-size: 11px; font-weight: 600; background: #eee; color: #555; }
+        .badge-active { background: #e8f5e9; color: #2e7d32; }
+        .badge-revoked { background: #fce4ec; color: #c62828; }
+        .secret { background: #e8f5e9; border-radius: 10px; padding: 12px 16px; margin-top: 16px; font-size: 13px; }
+        .secret code { display: block; margin-top: 6px; font-size: 13px; word-break: break-all; }
+        .muted { color: #999; font-size: 12px; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>API Tokens</h1>
+        <p class="subtitle">Tokens for automations calling <a href="/api/v1/openapi.json">/api/v1</a>. <a href="/">Back to the dashboard</a></p>
+
+        <div class="card">
+            <h2>New Token</h2>
+            <form class="filters" onsubmit="createToken(); return false;">
+                <div><label for="name">Name</label><input type="text" id="name" placeholder="e.g. finance-sync" maxlength="100" required></div>
+                <div><label for="scope">Scope</label>
+                    <select id="scope">
+                        <option value="read">Read only</option>
+                        <option value="plan">Plan (read and preview plans)</option>
+                        <option value="execute">Execute (plan and run disbursements)</option>
+                    </select></div>
+                <div><label for="days">Expires after (days)</label><input type="number" id="days" value="90" min="1" max="365"></div>
+                <div><button class="btn btn-primary" type="submit" id="createBtn">Create token</button></div>
+            </form>
+            <div id="created"></div>
+        </div>
+
+        <div class="card">
+            <h2>Tokens</h2>
+            <div id="tokens"><p class="muted">Loading…</p></div>
+        </div>
+    </div>
+
+    <script>
+    function escapeHTML(text) {
+        return String(text).replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;').replace(/"/g, '&quot;');
+    }
+
+    function when(at) {
+        return at ? new Date(at).toLocaleString() : '–';
+    }
+
+    function loadTokens() {
+        fetch('/api/tokens')
+            .then(r => r.json())
+            .then(data => {
+                if (data.error) throw new Error(data.error);
+                if (data.tokens.length === 0) {
+                    document.getElementById('tokens').innerHTML = '<p class="muted">No tokens yet.</p>';
+                    return;
+                }
+                let html = '<table class="event-table"><thead><tr><th>Name</th><th>Scope</th><th>Token</th><th>Status</th><th>Created</th><th>Expires</th><th>Last used</th><th></th></tr></thead><tbody>';
+                data.tokens.forEach(t => {
+                    const revoked = t.revoked_at ? '<div class="muted">' + when(t.revoked_at) + ' by ' + escapeHTML(t.revoked_by) + '</div>' : '';
+                    const used = t.last_used_at ? when(t.last_used_at) + '<div class="muted">' + escapeHTML(t.last_used_ip || '') + '</div>' : 'Never';
+                    html += '<tr><td>' + escapeHTML(t.name) + '</td><td>' + t.scope + '</td><td><code>' + escapeHTML(t.hint) + '</code></td>'
+                        + '<td><span class="badge badge-' + t.status + '">' + t.status + '</span>' + revoked + '</td>'
+                        + '<td>' + when(t.created_at) + '<div class="muted">by ' + escapeHTML(t.created_by) + '</div></td>'
+                        + '<td>' + when(t.expires_at) + '</td><td>' + used + '</td>'
+                        + '<td>' + (t.status === 'active' ? '<button class="btn btn-danger" onclick="revokeToken(\'' + t.id + '\', this)">Revoke</button>' : '') + '</td></tr>';
+                });
+                document.getElementById('tokens').innerHTML = html + '</tbody></table>';
+            })
+            .catch(err => {
+                document.getElementById('tokens').innerHTML = '<p style="color:#c62828;">Error: ' + escapeHTML(err.message) + '</p>';
+            });
+    }
+
+    function createToken() {
+        const btn = document.getElementById('createBtn');
+        btn.disabled = true;
+        fetch('/api/tokens', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                name: document.getElementById('name').value,
+                scope: document.getElementById('scope').value,
+                expires_in_days: parseInt(document.getElementById('days').value, 10) || 0,
+            }),
+        })
+            .then(r => r.json())
+            .then(data => {
+                if (data.error) throw new Error(data.error);
+                document.getElementById('created').innerHTML = '<div class="secret">Copy the token for <strong>' + escapeHTML(data.token.name)
+                    + '</strong> now; it will not be shown again.<code>' + escapeHTML(data.secret) + '</code></div>';
+                document.getElementById('name').value = '';
+                loadTokens();
+            })
+            .catch(err => {
+                document.getElementById('created').innerHTML = '<p style="color:#c62828;margin-top:12px;">Error: ' + escapeHTML(err.message) + '</p>';
+            })
+            .finally(() => { btn.disabled = false; });
+    }
+
+    function revokeToken(id, btn) {
+        if (!confirm('Revoke this token? Anything using it will stop working immediately.')) return;
+        btn.disabled = true;
+        fetch('/api/tokens/' + encodeURIComponent(id) + '/revoke', { method: 'POST' })
+            .then(r => r.json())
+            .then(data => {
+                if (data.error) throw new Error(data.error);
+                loadTokens();
+            })
+            .catch(err => {
+                alert('Error: ' + err.message);
+                btn.disabled = false;
+            });
+    }
+
+    loadTokens();
+    </script>
+</body>
+</html>`
+
+func main() {
+	err := godotenv.Load()
+	setupLogging()
+	if err != nil {
+		slog.Info("No .env file found, using environment variables")
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		slog.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	if errs := validateConfig(requiredSettings(os.Args[1:])); len(errs) > 0 {
+		for _, err := range errs {
+			slog.Error("Invalid configuration", "error", err)
+		}
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		drainOnSignal()
+		code := runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+		webhookWG.Wait()
+		shutdownTracing(context.Background())
+		os.Exit(code)
+	}
+
+	r := gin.New()
+	r.Use(requestLogger(), gin.Recovery())
+
+	r.GET("/healthz", handleHealthz)
+	r.GET("/readyz", handleReadyz)
+
+	// Basic Auth middleware
+	authorized := r.Group("/", gin.BasicAuth(gin.Accounts{
+		os.Getenv("BASIC_AUTH_USERNAME"): os.Getenv("BASIC_AUTH_PASSWORD"),
+	}), logUser())
+
+	authorized.GET("/", serveDashboard)
+	authorized.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	authorized.GET("/api/preview", handlePreview)
+	authorized.POST("/trigger-disbursements", triggerDisbursements)
+	authorized.POST("/trigger-custom-disbursements", triggerCustomDisbursements)
+	authorized.POST("/api/preview/upload", handlePreviewUpload)
+	authorized.POST("/trigger-upload-disbursements", triggerUploadDisbursements)
+	authorized.GET("/history", serveHistory)
+	authorized.GET("/api/disbursements", handleListDisbursements)
+	authorized.GET("/api/disbursements/:id", handleGetDisbursement)
+	authorized.GET("/api/export", handleExport)
+	authorized.GET("/events/:hcb_event_id", serveEventTimeline)
+	authorized.GET("/api/events/:hcb_event_id/timeline", handleEventTimeline)
+	authorized.GET("/api/runs", handleListRuns)
+	authorized.POST("/api/runs/:id/approve", handleApproveRun)
+	authorized.POST("/api/runs/:id/reject", handleRejectRun)
+	authorized.POST("/api/runs/:id/resume", handleResumeRun)
+	authorized.GET("/api/webhooks/deliveries", handleListDeliveries)
+	authorized.POST("/api/webhooks/deliveries/:id/redeliver", handleRedeliver)
+	authorized.GET("/tokens", serveTokens)
+	authorized.GET("/api/tokens", handleListTokens)
+	authorized.POST("/api/tokens", handleCreateToken)
+	authorized.POST("/api/tokens/:id/revoke", handleRevokeToken)
+
+	// The JSON API authenticates each route itself, so API tokens work there
+	registerAPIv1(r.Group("/api/v1"))
+	r.NoRoute(handleNoRoute)
+
+	scheduler, err := startScheduler()
+	if err != nil {
+		slog.Error("Failed to start scheduler", "error", err)
+		os.Exit(1)
+	}
+
+	reportInterruptedRuns(context.Background())
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	go func() {
+		slog.Info("Starting server", "port", port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// On SIGINT/SIGTERM: refuse new runs, stop the scheduler, let the run in
+	// progress finish its current event and save its cursor, then close the
+	// listener once in-flight requests have returned.
+	<-drainOnSignal()
+	if scheduler != nil {
+		scheduler.Stop()
+	}
+	waitForRuns()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("Server shutdown failed", "error", err)
+	}
+	webhookWG.Wait()
+	slog.Info("Server stopped")
+}
+
+// refuseWhileDraining answers 503 once shutdown has begun, so no new run
+// starts on an instance that is going away.
+func refuseWhileDraining(c *gin.Context) bool {
+	if isDraining() {
+		c.JSON(503, gin.H{"error": "Server is shutting down; try again shortly"})
+		return true
+	}
+	return false
+}
+
+// requestLogger logs one line per request in place of gin's text logger.
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		slog.InfoContext(c.Request.Context(), "Request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP())
+	}
+}
+
+// logUser tags the request context with the authenticated user so every log
+// line from the handler carries it.
+func logUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := withLogAttrs(c.Request.Context(), "user", c.GetString(gin.AuthUserKey))
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+func handleHealthz(c *gin.Context) {
+	c.JSON(200, gin.H{"status": "ok"})
+}
+
+func handleReadyz(c *gin.Context) {
+	ready, checks := checkReadiness(c.Request.Context())
+	if !ready {
+		c.JSON(503, gin.H{"status": "unavailable", "checks": checks})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "ok", "checks": checks})
+}
+
+func serveDashboard(c *gin.Context) {
+	lastRun := "Never"
+	if !stats.LastRun.IsZero() {
+		lastRun = stats.LastRun.Format("2006-01-02 15:04:05 MST")
+	}
+
+	html := fmt.Sprintf(dashboardHTML,
+		stats.TotalEvents,
+		stats.EventsWithAmount,
+		stats.TotalAmountOwed,
+		stats.DisbursementsCreated,
+		stats.ProcessedCount,
+		stats.FailedCount,
+		lastRun)
+
+	c.Header("Content-Type", "text/html")
+	c.String(200, html)
+}
+
+func handlePreview(c *gin.Context) {
+	customAmountStr := c.Query("custom_amount")
+
+	if customAmountStr != "" {
+		customAmount, err := parseAmount(customAmountStr)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid custom amount"})
+			return
+		}
+		target, err := parseEventTarget(c.Query)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		events, err := getAllEvents(c.Request.Context(), target)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to fetch events: %v", err)})
+			return
+		}
+		plan := buildCustomPlan(c.Request.Context(), events, customAmount, target)
+		plan.setMemo(strings.TrimSpace(c.Query("memo")))
+		c.JSON(200, plan)
+		return
+	}
+
+	events, err := getAllEvents(c.Request.Context(), EventTarget{})
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to fetch events: %v", err)})
+		return
+	}
+
+	c.JSON(200, buildAutograntPlan(c.Request.Context(), events))
+}
+
+func triggerDisbursements(c *gin.Context) {
+	if refuseWhileDraining(c) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	slog.InfoContext(ctx, "Starting disbursement process")
+
+	exclusions, err := parseExclusions(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	operator := c.GetString(gin.AuthUserKey)
+	buildPlan := func(ctx context.Context) (Plan, error) {
+		// Get all events from Airtable
+		events, err := getAllEvents(ctx, EventTarget{})
+		if err != nil {
+			return Plan{}, err
+		}
+		plan := buildAutograntPlan(ctx, events)
+		plan.excludeEvents(exclusions, operator)
+		return plan, nil
+	}
+
+	plan, err := buildPlan(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error fetching events", "error", err)
+		c.String(500, "Error fetching events: %v", err)
+		return
+	}
+	if !planMatchesPreview(c, plan) {
+		return
+	}
+	run := newRun(plan, "dashboard", operator)
+	if !startDashboardRun(c, run, buildPlan) {
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"created":   run.Created,
+		"processed": run.Processed,
+		"failed":    run.Failed,
+	})
+}
+
+func triggerCustomDisbursements(c *gin.Context) {
+	if refuseWhileDraining(c) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	slog.InfoContext(ctx, "Starting custom disbursement process")
+
+	customAmountStr := c.PostForm("custom_amount")
+	if customAmountStr == "" {
+		c.String(400, "Custom amount is required")
+		return
+	}
+
+	customAmount, err := parseAmount(customAmountStr)
+	if err != nil {
+		c.String(400, "Invalid amount format: %v", err)
+		return
+	}
+
+	target, err := parseEventTarget(c.PostForm)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	exclusions, err := parseExclusions(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	operator := c.GetString(gin.AuthUserKey)
+	memo := strings.TrimSpace(c.PostForm("memo"))
+	buildPlan := func(ctx context.Context) (Plan, error) {
+		// Get the targeted events from Airtable
+		events, err := getAllEvents(ctx, target)
+		if err != nil {
+			return Plan{}, err
+		}
+		plan := buildCustomPlan(ctx, events, customAmount, target)
+		plan.setMemo(memo)
+		plan.excludeEvents(exclusions, operator)
+		return plan, nil
+	}
+
+	plan, err := buildPlan(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error fetching events", "error", err)
+		c.String(500, "Error fetching events: %v", err)
+		return
+	}
+	if !planMatchesPreview(c, plan) || !clawbacksConfirmed(c, plan) {
+		return
+	}
+	run := newRun(plan, "dashboard", operator)
+	if !startDashboardRun(c, run, buildPlan) {
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"created":   run.Created,
+		"processed": run.Processed,
+		"failed":    run.Failed,
+	})
+}
+
+func handlePreviewUpload(c *gin.Context) {
+	plan, _, ok := uploadPlan(c)
+	if !ok {
+		return
+	}
+	c.JSON(200, plan)
+}
+
+func triggerUploadDisbursements(c *gin.Context) {
+	if refuseWhileDraining(c) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	slog.InfoContext(ctx, "Starting uploaded disbursement process")
+
+	plan, rows, ok := uploadPlan(c)
+	if !ok {
+		return
+	}
+
+	exclusions, err := parseExclusions(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	operator := c.GetString(gin.AuthUserKey)
+	plan.excludeEvents(exclusions, operator)
+	if !planMatchesPreview(c, plan) || !clawbacksConfirmed(c, plan) {
+		return
+	}
+	run := newRun(plan, "dashboard", operator)
+	replan := func(ctx context.Context) (Plan, error) {
+		events, err := getAllEvents(ctx, EventTarget{})
+		if err != nil {
+			return Plan{}, err
+		}
+		// Rows that no longer match an event drop out and show as differences
+		current, _ := buildUploadPlan(ctx, events, rows, plan.Upload)
+		current.setMemo(plan.Memo)
+		current.excludeEvents(exclusions, operator)
+		return current, nil
+	}
+	if !startDashboardRun(c, run, replan) {
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"created":   run.Created,
+		"processed": run.Processed,
+		"failed":    run.Failed,
+	})
+}
+
+// uploadPlan builds a plan from the uploaded file field and checks it against
+// the events view, returning the file's rows with it. On failure it writes
+// the response, listing every problem in the file, and returns false.
+func uploadPlan(c *gin.Context) (Plan, []UploadRow, bool) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(400, gin.H{"error": "A CSV or JSON file is required"})
+		return Plan{}, nil, false
+	}
+	if header.Size > maxUploadSize {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("The upload is larger than %d bytes", maxUploadSize)})
+		return Plan{}, nil, false
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Failed to read upload: %v", err)})
+		return Plan{}, nil, false
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Failed to read upload: %v", err)})
+		return Plan{}, nil, false
+	}
+
+	rows, err := parseUpload(header.Filename, data)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return Plan{}, nil, false
+	}
+
+	events, err := getAllEvents(c.Request.Context(), EventTarget{})
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to fetch events: %v", err)})
+		return Plan{}, nil, false
+	}
+
+	plan, problems := buildUploadPlan(c.Request.Context(), events, rows, header.Filename)
+	if len(problems) > 0 {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("%d problems in %s", len(problems), header.Filename), "problems": problems})
+		return Plan{}, nil, false
+	}
+	plan.setMemo(strings.TrimSpace(c.PostForm("memo")))
+	return plan, rows, true
+}
+
+// clawbacksConfirmed refuses a plan that pulls money back from events unless
+// the request carries confirm_clawback=true, so a stray minus sign never
+// claws back by accident. It writes the response when it refuses.
+func clawbacksConfirmed(c *gin.Context, plan Plan) bool {
+	count, total := plan.clawbacks()
+	if count == 0 || c.PostForm("confirm_clawback") == "true" {
+		return true
+	}
+	c.JSON(400, gin.H{"error": fmt.Sprintf("This run claws back $%.2f from %d events; resend with confirm_clawback=true to confirm", total, count)})
+	return false
+}
+
+// planMatchesPreview refuses a plan that differs from what the operator
+// confirmed. The request's optional expected form field is a JSON list of
+// {"record_id", "amount"} objects for the events that were ticked in the
+// preview; the plan is rebuilt from live data, so if a balance changed or an
+// event appeared or disappeared in the meantime the run is refused with 409
+// and the differences. It writes the response when it refuses.
+func planMatchesPreview(c *gin.Context, plan Plan) bool {
+	raw := c.PostForm("expected")
+	if raw == "" {
+		return true
+	}
+
+	var expected []ExpectedItem
+	if err := json.Unmarshal([]byte(raw), &expected); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("invalid expected: %v", err)})
+		return false
+	}
+	if diffs := plan.differences(expected); len(diffs) > 0 {
+		c.JSON(409, gin.H{
+			"error":       fmt.Sprintf("%d events changed since the preview; preview again before sending", len(diffs)),
+			"differences": diffs,
+		})
+		return false
+	}
+	return true
+}
+
+// startDashboardRun starts the run with startRun. If the plan changed while
+// it waited for another run it is refused with 409 and the differences, like
+// planMatchesPreview. It writes the response when it refuses.
+func startDashboardRun(c *gin.Context, run *Run, replan func(context.Context) (Plan, error)) bool {
+	err := startRun(c.Request.Context(), run, replan)
+	var changed *planChangedError
+	if errors.As(err, &changed) {
+		c.JSON(409, gin.H{
+			"error":       fmt.Sprintf("%d events changed while another run was sending; preview again before sending", len(changed.differences)),
+			"differences": changed.differences,
+		})
+		return false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to start the run: %v", err)})
+		return false
+	}
+	return true
+}
+
+// parseExclusions reads the optional exclusions form field: a JSON list of
+// {"record_id", "reason"} objects for events the operator unticked in the
+// preview. Every exclusion needs a reason.
+func parseExclusions(c *gin.Context) (map[string]string, error) {
+	raw := c.PostForm("exclusions")
+	if raw == "" {
+		return nil, nil
+	}
+
+	var exclusions []ExclusionRequest
+	if err := json.Unmarshal([]byte(raw), &exclusions); err != nil {
+		return nil, fmt.Errorf("invalid exclusions: %v", err)
+	}
+	return exclusionReasons(exclusions)
+}
+
+func handleListRuns(c *gin.Context) {
+	runs, err := runStore.List()
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to load runs: %v", err)})
+		return
+	}
 
-func main() {
-	err := godotenv.Load()
+	status := c.Query("status")
+	filtered := []Run{}
+	for _, run := range runs {
+		if status == "" || run.Status == status {
+			filtered = append(filtered, run)
+		}
+	}
+
+	c.JSON(200, gin.H{"runs": filtered})
+}
+
+func serveHistory(c *gin.Context) {
+	c.Header("Content-Type", "text/html")
+	c.String(200, historyHTML)
+}
+
+func handleListDisbursements(c *gin.Context) {
+	filter, err := parseHistoryFilter(c.Query)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	page, perPage, err := parsePage(c.Query)
 	if err != nil {
-		log.Println("No .env file found, using environment variables")
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
 	}
 
-	r := gin.Default()
+	entries, err := listDisbursements(filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to load runs: %v", err)})
+		return
+	}
 
-	// Basic Auth middleware
-	authorized := r.Group("/", gin.BasicAuth(gin.Accounts{
-		os.Getenv("BASIC_AUTH_USERNAME"): os.Getenv("BASIC_AUTH_PASSWORD"),
-	}))
+	items, pages := paginate(entries, page, perPage)
+	c.JSON(200, DisbursementPage{Disbursements: items, Page: page, PerPage: perPage, Pages: pages, Total: len(entries)})
+}
 
-	authorized.GET("/", serveDashboard)
-	authorized.GET("/api/preview", handlePreview)
-	authorized.POST("/trigger-disbursements", triggerDisbursements)
-	authorized.POST("/trigger-custom-disbursements", triggerCustomDisbursements)
+// handleExport downloads the disbursements the history filters select, e.g.
+// one run with ?run=<id> or a date range with ?from=&to=.
+func handleExport(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if !validExportFormat(format) {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("format must be one of %s", strings.Join(exportFormats, ", "))})
+		return
+	}
+	filter, err := parseHistoryFilter(c.Query)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	entries, err := listDisbursements(filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to load runs: %v", err)})
+		return
 	}
 
-	log.Printf("Starting server on port %s", port)
-	r.Run(":" + port)
+	name := "disbursements"
+	if filter.RunID != "" {
+		name += "-" + filter.RunID
+	}
+	if format == "journal" {
+		name += "-journal"
+	}
+	c.Header("Content-Type", exportContentType(format))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+exportExtension(format)))
+	c.Status(200)
+	if err := writeExport(c.Writer, format, entries); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to write export", "error", err)
+	}
 }
 
-func serveDashboard(c *gin.Context) {
-	lastRun := "Never"
-	if !stats.LastRun.IsZero() {
-		lastRun = stats.LastRun.Format("2006-01-02 15:04:05 MST")
+// handleGetDisbursement returns a disbursement's run history entry with its
+// Airtable record and HCB's current view of the transfer.
+func handleGetDisbursement(c *gin.Context) {
+	detail, err := disbursementDetail(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, errNotFound) {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, errAirtable) {
+		c.JSON(502, gin.H{"error": fmt.Sprintf("Failed to fetch the disbursement: %v", err)})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to load the run history: %v", err)})
+		return
 	}
 
-	html := fmt.Sprintf(dashboardHTML,
-		stats.TotalEvents,
-		stats.EventsWithAmount,
-		stats.TotalAmountOwed,
-		stats.DisbursementsCreated,
-		stats.ProcessedCount,
-		stats.FailedCount,
-		lastRun)
+	c.JSON(200, detail)
+}
 
+func serveEventTimeline(c *gin.Context) {
 	c.Header("Content-Type", "text/html")
-	c.String(200, html)
+	c.String(200, eventHTML)
 }
 
-func handlePreview(c *gin.Context) {
-	customAmountStr := c.Query("custom_amount")
+func handleEventTimeline(c *gin.Context) {
+	hcbEventID := c.Param("hcb_event_id")
+	if !hcbEventIDPattern.MatchString(hcbEventID) {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("%q is not an HCB organization", hcbEventID)})
+		return
+	}
 
-	events, err := getAllEvents()
+	timeline, err := eventTimeline(c.Request.Context(), hcbEventID)
 	if err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to fetch events: %v", err)})
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to load the run history: %v", err)})
+		return
+	}
+	c.JSON(200, timeline)
+}
+
+func handleApproveRun(c *gin.Context) {
+	if refuseWhileDraining(c) {
 		return
 	}
 
-	type EventPreview struct {
-		RecordID   string  `json:"record_id"`
-		HCBEventID string  `json:"hcb_event_id"`
-		Amount     float64 `json:"amount"`
-		Direction  string  `json:"direction"`
+	run, err := approveRun(c.Request.Context(), c.Param("id"), c.GetString(gin.AuthUserKey))
+	if err != nil {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
 	}
 
-	var previews []EventPreview
-	totalAmount := 0.0
+	c.JSON(200, gin.H{
+		"created":   run.Created,
+		"processed": run.Processed,
+		"failed":    run.Failed,
+	})
+}
 
-	if customAmountStr != "" {
-		customAmount, err := strconv.ParseFloat(customAmountStr, 64)
-		if err != nil {
-			c.JSON(400, gin.H{"error": "Invalid custom amount"})
-			return
-		}
-		for _, event := range events {
-			previews = append(previews, EventPreview{
-				RecordID:   event.ID,
-				HCBEventID: event.Fields.HCBEventID,
-				Amount:     customAmount,
-				Direction:  "grant",
-			})
-			totalAmount += customAmount
-		}
-	} else {
-		for _, event := range events {
-			if event.Fields.AmountOwed != 0 {
-				direction := "grant"
-				if event.Fields.AmountOwed < 0 {
-					direction = "withdrawal"
-				}
-				previews = append(previews, EventPreview{
-					RecordID:   event.ID,
-					HCBEventID: event.Fields.HCBEventID,
-					Amount:     event.Fields.AmountOwed,
-					Direction:  direction,
-				})
-				totalAmount += event.Fields.AmountOwed
-			}
-		}
+func handleResumeRun(c *gin.Context) {
+	if refuseWhileDraining(c) {
+		return
+	}
+
+	run, err := resumeRun(c.Request.Context(), c.Param("id"), c.GetString(gin.AuthUserKey))
+	if err != nil {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(200, gin.H{
-		"events":       previews,
-		"total_events": len(events),
-		"total_amount": totalAmount,
-		"event_count":  len(previews),
+		"created":   run.Created,
+		"processed": run.Processed,
+		"failed":    run.Failed,
 	})
 }
 
-func triggerDisbursements(c *gin.Context) {
-	log.Println("Starting disbursement process...")
-	
-	stats = DisbursementStats{}
-	stats.LastRun = time.Now()
-	
-	// Get all events from Airtable
-	events, err := getAllEvents()
-	if err != nil {
-		log.Printf("Error fetching events: %v", err)
-		c.String(500, "Error fetching events: %v", err)
+func handleRejectRun(c *gin.Context) {
+	run, err := rejectRun(c.Request.Context(), c.Param("id"), c.GetString(gin.AuthUserKey))
+	if err != nil {
+		c.JSON(409, gin.H{"error": err.Error()})
 		return
 	}
 
-	stats.TotalEvents = len(events)
-	log.Printf("Found %d total events", len(events))
+	c.JSON(200, run)
+}
+
+func handleListDeliveries(c *gin.Context) {
+	deliveries, err := deliveryStore.List()
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to load webhook deliveries: %v", err)})
+		return
+	}
 
-	var processedEvents []AirtableEvent
-	for _, event := range events {
-		if event.Fields.AmountOwed > 0 {
-			processedEvents = append(processedEvents, event)
-			stats.TotalAmountOwed += event.Fields.AmountOwed
+	status := c.Query("status")
+	filtered := []WebhookDelivery{}
+	for _, delivery := range deliveries {
+		if status == "" || delivery.Status == status {
+			filtered = append(filtered, delivery)
 		}
 	}
 
-	stats.EventsWithAmount = len(processedEvents)
-	log.Printf("Found %d events with amount owed > 0, total amount: $%.2f", len(processedEvents), stats.TotalAmountOwed)
+	c.JSON(200, gin.H{"deliveries": filtered})
+}
 
-	// Process each event including negative amounts
-	for _, event := range events {
-		if event.Fields.AmountOwed != 0 { // Process both positive and negative amounts
-			err := processDisbursement(event)
-			if err != nil {
-				log.Printf("Error processing disbursement for event %s: %v", event.ID, err)
-				stats.FailedCount++
-			} else {
-				stats.ProcessedCount++
-			}
-			stats.DisbursementsCreated++
-		}
+func handleRedeliver(c *gin.Context) {
+	delivery, err := redeliverWebhook(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
 	}
 
-	log.Printf("Disbursement process completed. Created: %d, Processed: %d, Failed: %d", 
-		stats.DisbursementsCreated, stats.ProcessedCount, stats.FailedCount)
+	c.JSON(200, delivery)
+}
 
-	c.JSON(200, gin.H{
-		"created":   stats.DisbursementsCreated,
-		"processed": stats.ProcessedCount,
-		"failed":    stats.FailedCount,
-	})
+func serveTokens(c *gin.Context) {
+	c.Header("Content-Type", "text/html")
+	c.String(200, tokensHTML)
 }
 
-func triggerCustomDisbursements(c *gin.Context) {
-	log.Println("Starting custom disbursement process...")
-	
-	customAmountStr := c.PostForm("custom_amount")
-	if customAmountStr == "" {
-		c.String(400, "Custom amount is required")
+func handleListTokens(c *gin.Context) {
+	tokens, err := tokenStore.List()
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to load API tokens: %v", err)})
 		return
 	}
-	
-	var customAmount float64
-	_, err := fmt.Sscanf(customAmountStr, "%f", &customAmount)
-	if err != nil {
-		c.String(400, "Invalid amount format: %v", err)
+
+	now := time.Now()
+	for i := range tokens {
+		tokens[i] = tokens[i].public(now)
+	}
+	c.JSON(200, TokenList{Tokens: tokens})
+}
+
+// handleCreateToken creates a token from a JSON TokenRequest. The secret is
+// in this response only.
+func handleCreateToken(c *gin.Context) {
+	var req TokenRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid token request: %v", err)})
 		return
 	}
-	
-	// Get all events from Airtable
-	events, err := getAllEvents()
+
+	token, err := createToken(c.Request.Context(), req, c.GetString(gin.AuthUserKey))
 	if err != nil {
-		log.Printf("Error fetching events: %v", err)
-		c.String(500, "Error fetching events: %v", err)
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	
-	log.Printf("Found %d events for custom disbursement of $%.2f each", len(events), customAmount)
-	
-	processedCount := 0
-	failedCount := 0
-	
-	// Process each event with custom amount
-	for _, event := range events {
-		err := processCustomDisbursement(event, customAmount)
-		if err != nil {
-			log.Printf("Error processing custom disbursement for event %s: %v", event.ID, err)
-			failedCount++
-		} else {
-			processedCount++
-		}
-	}
-	
-	log.Printf("Custom disbursement process completed. Processed: %d, Failed: %d", processedCount, failedCount)
+	c.JSON(201, token)
+}
 
-	c.JSON(200, gin.H{
-		"created":   processedCount + failedCount,
-		"processed": processedCount,
-		"failed":    failedCount,
-	})
+func handleRevokeToken(c *gin.Context) {
+	token, err := revokeToken(c.Request.Context(), c.Param("id"), c.GetString(gin.AuthUserKey))
+	if errors.Is(err, errNotFound) {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, errTokenRevoked) {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to revoke API token: %v", err)})
+		return
+	}
+	c.JSON(200, token)
 }
 
-func getAllEvents() ([]AirtableEvent, error) {
-	var allEvents []AirtableEvent
+// getAllEvents pages through the events the target selects; the zero target
+// is the whole events view.
+func getAllEvents(ctx context.Context, target EventTarget) (allEvents []AirtableEvent, err error) {
+	ctx, span := tracer.Start(ctx, "airtable.getAllEvents", trace.WithAttributes(
+		attribute.String("airtable.view", target.query().Get("view")),
+		attribute.Bool("airtable.filtered", target.Formula != "" || len(target.RecordIDs) > 0),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("airtable.events", len(allEvents)))
+		endSpan(span, err)
+	}()
+
 	offset := ""
 
 	for {
-		events, nextOffset, err := getEventsPage(offset)
+		events, nextOffset, err := getEventsPage(ctx, target, offset)
 		if err != nil {
 			return nil, err
 		}
@@ -555,20 +1831,23 @@ func getAllEvents() ([]AirtableEvent, error) {
 		offset = nextOffset
 	}
 
+	if err := target.checkSelected(allEvents); err != nil {
+		return nil, err
+	}
 	return allEvents, nil
 }
 
-func getEventsPage(offset string) ([]AirtableEvent, string, error) {
+func getEventsPage(ctx context.Context, target EventTarget, offset string) ([]AirtableEvent, string, error) {
 	baseID := os.Getenv("AIRTABLE_BASE_ID")
 	apiKey := os.Getenv("AIRTABLE_API_KEY")
-	viewID := "viwjvoyfA2Cgc4XE4"
 
-	url := fmt.Sprintf("https://api.airtable.com/v0/%s/events?view=%s", baseID, viewID)
+	query := target.query()
 	if offset != "" {
-		url += "&offset=" + offset
+		query.Set("offset", offset)
 	}
+	url := fmt.Sprintf("https://api.airtable.com/v0/%s/events?%s", baseID, query.Encode())
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, "", err
 	}
@@ -576,8 +1855,7 @@ func getEventsPage(offset string) ([]AirtableEvent, string, error) {
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := airtableClient.Do(req)
 	if err != nil {
 		return nil, "", err
 	}
@@ -601,51 +1879,179 @@ func getEventsPage(offset string) ([]AirtableEvent, string, error) {
 	return response.Records, response.Offset, nil
 }
 
-func processDisbursement(event AirtableEvent) error {
-	log.Printf("Processing disbursement for event %s (HCB ID: %s, Amount: $%.2f)", 
-		event.ID, event.Fields.HCBEventID, event.Fields.AmountOwed)
+// getDisbursementsByStatus returns the disbursement records with the given
+// status, e.g. pending records whose run stopped between creation and the
+// status update.
+func getDisbursementsByStatus(ctx context.Context, status string) ([]AirtableDisbursementResponse, error) {
+	return getDisbursements(ctx, fmt.Sprintf("{status}='%s'", status))
+}
 
-	// Create disbursement in Airtable
-	disbursement, err := createDisbursement(event)
-	if err != nil {
-		return fmt.Errorf("failed to create disbursement: %v", err)
+// getDisbursements returns every disbursement record matching formula, or
+// every record when formula is empty.
+func getDisbursements(ctx context.Context, formula string) ([]AirtableDisbursementResponse, error) {
+	baseID := os.Getenv("AIRTABLE_BASE_ID")
+	apiKey := os.Getenv("AIRTABLE_API_KEY")
+
+	var allDisbursements []AirtableDisbursementResponse
+	offset := ""
+
+	for {
+		params := url.Values{}
+		if formula != "" {
+			params.Set("filterByFormula", formula)
+		}
+		if offset != "" {
+			params.Set("offset", offset)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://api.airtable.com/v0/%s/disbursements?%s", baseID, params.Encode()), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := airtableClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("airtable API error: %s", string(body))
+		}
+
+		var response struct {
+			Records []AirtableDisbursementResponse `json:"records"`
+			Offset  string                         `json:"offset,omitempty"`
+		}
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			return nil, err
+		}
+
+		allDisbursements = append(allDisbursements, response.Records...)
+
+		if response.Offset == "" {
+			break
+		}
+		offset = response.Offset
 	}
 
-	log.Printf("Created disbursement %d for event %s", 
-		disbursement.Fields.DisbursementID, event.ID)
+	return allDisbursements, nil
+}
 
-	// Send to HCB
-	err = sendHCBTransfer(event, disbursement.Fields.DisbursementID)
-	if err != nil {
-		// Update disbursement as failed
-		notes := fmt.Sprintf("HCB transfer failed: %v. Created at %s", err, time.Now().Format("2006-01-02 15:04:05 MST"))
-		updateErr := updateDisbursementStatus(disbursement.ID, "failed", notes)
-		if updateErr != nil {
-			log.Printf("Failed to update disbursement status: %v", updateErr)
+func processDisbursement(ctx context.Context, event AirtableEvent, text TransferText, progress *RunResult, checkpoint func()) error {
+	if progress.Step == stepPlanned {
+		slog.InfoContext(ctx, "Processing disbursement", "amount", event.Fields.AmountOwed)
+
+		// Create disbursement in Airtable
+		disbursement, err := createDisbursement(ctx, event)
+		if err != nil {
+			return fmt.Errorf("failed to create disbursement: %v", err)
 		}
-		return fmt.Errorf("HCB transfer failed: %v", err)
+		progress.DisbursementRecordID = disbursement.ID
+		progress.DisbursementID = disbursement.Fields.DisbursementID
+		progress.Step = stepRecordCreated
+		checkpoint()
+		slog.InfoContext(withLogAttrs(ctx, "disbursement_id", progress.DisbursementID), "Created disbursement", "disbursement_record_id", disbursement.ID)
 	}
 
-	// Update disbursement as processed
-	var notes string
-	if event.Fields.AmountOwed < 0 {
-		notes = fmt.Sprintf("Successfully processed HCB withdrawal. Received $%.2f from organization %s. Completed at %s", 
-			-event.Fields.AmountOwed, event.Fields.HCBEventID, time.Now().Format("2006-01-02 15:04:05 MST"))
-	} else {
-		notes = fmt.Sprintf("Successfully processed HCB transfer. Sent $%.2f to organization %s. Completed at %s", 
-			event.Fields.AmountOwed, event.Fields.HCBEventID, time.Now().Format("2006-01-02 15:04:05 MST"))
+	ctx = withLogAttrs(ctx, "disbursement_id", progress.DisbursementID)
+	text.DisbursementID = progress.DisbursementID
+
+	switch progress.Step {
+	case stepRecordCreated:
+		// Saved before sending so a crash mid-request is never resent
+		progress.Step = stepTransferStarted
+		checkpoint()
+
+		// Send to HCB
+		transfer, err := sendHCBTransfer(ctx, event, text.name())
+		if errors.Is(err, errTransferUnknown) {
+			// The transfer may exist; stay at transfer_started so it is
+			// never sent again
+			return err
+		}
+		if err != nil {
+			progress.Step = stepTransferFailed
+			checkpoint()
+
+			// Update disbursement as failed
+			notes := text.withMemo(fmt.Sprintf("HCB transfer failed: %v. Created at %s", err, time.Now().Format("2006-01-02 15:04:05 MST")))
+			updateErr := updateDisbursementStatus(ctx, progress.DisbursementRecordID, "failed", notes)
+			if updateErr != nil {
+				slog.ErrorContext(ctx, "Failed to update disbursement status", "error", updateErr)
+			}
+			return fmt.Errorf("HCB transfer failed: %v", err)
+		}
+		progress.HCBTransferID = transfer.ID
+		progress.HCBTransferStatus = transfer.Status
+		progress.Step = stepTransferSent
+		checkpoint()
+	case stepTransferFailed:
+		return resumeFailedTransfer(ctx, progress, text)
+	case stepTransferStarted:
+		return errTransferUnknown
+	case stepBalanceStarted:
+		return errBalanceUnknown
 	}
-	err = updateDisbursementStatus(disbursement.ID, "processed", notes)
-	if err != nil {
-		log.Printf("Failed to update disbursement status: %v", err)
-		return err
+
+	if progress.Step == stepTransferSent {
+		// Update disbursement as processed
+		var notes string
+		if event.Fields.AmountOwed < 0 {
+			notes = fmt.Sprintf("Successfully processed HCB withdrawal. Received $%.2f from organization %s. Completed at %s", 
+				-event.Fields.AmountOwed, event.Fields.HCBEventID, time.Now().Format("2006-01-02 15:04:05 MST"))
+		} else {
+			notes = fmt.Sprintf("Successfully processed HCB transfer. Sent $%.2f to organization %s. Completed at %s", 
+				event.Fields.AmountOwed, event.Fields.HCBEventID, time.Now().Format("2006-01-02 15:04:05 MST"))
+		}
+		err := updateSubmittedDisbursement(ctx, progress, text.withMemo(notes))
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to update disbursement status", "error", err)
+			return err
+		}
+		progress.Step = stepStatusUpdated
+		checkpoint()
+	}
+
+	// Record the payment on the event so the next run does not pay it again
+	if progress.Step == stepStatusUpdated && balanceWriteback() != writebackOff {
+		progress.Step = stepBalanceStarted
+		progress.BalanceWriteback = balanceWriteback()
+		checkpoint()
+		if err := recordEventBalance(ctx, event, event.Fields.AmountOwed); err != nil {
+			slog.ErrorContext(ctx, "Failed to record the disbursement on the event", "writeback", balanceWriteback(), "error", err)
+			return fmt.Errorf("amount_owed write-back failed: %v", err)
+		}
+		progress.Step = stepBalanceUpdated
+		checkpoint()
 	}
 
-	log.Printf("Successfully completed disbursement %d", disbursement.Fields.DisbursementID)
+	slog.InfoContext(ctx, "Successfully completed disbursement")
 	return nil
 }
 
-func createDisbursement(event AirtableEvent) (*AirtableDisbursementResponse, error) {
+// resumeFailedTransfer finishes an event that stopped right after HCB refused
+// its transfer: the disbursement may not have been marked failed yet, and the
+// event must fail again rather than count as processed. No money moved, so
+// a retry may send it.
+func resumeFailedTransfer(ctx context.Context, progress *RunResult, text TransferText) error {
+	notes := text.withMemo(fmt.Sprintf("HCB transfer failed before the run was interrupted. Marked failed at %s", time.Now().Format("2006-01-02 15:04:05 MST")))
+	if err := updateDisbursementStatus(ctx, progress.DisbursementRecordID, "failed", notes); err != nil {
+		slog.ErrorContext(ctx, "Failed to update disbursement status", "error", err)
+	}
+	return fmt.Errorf("HCB transfer failed before the run was interrupted; retry the run to send it again")
+}
+
+func createDisbursement(ctx context.Context, event AirtableEvent) (*AirtableDisbursementResponse, error) {
 	baseID := os.Getenv("AIRTABLE_BASE_ID")
 	apiKey := os.Getenv("AIRTABLE_API_KEY")
 
@@ -676,7 +2082,7 @@ func createDisbursement(event AirtableEvent) (*AirtableDisbursementResponse, err
 	}
 
 	url := fmt.Sprintf("https://api.airtable.com/v0/%s/disbursements", baseID)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, err
 	}
@@ -684,8 +2090,7 @@ func createDisbursement(event AirtableEvent) (*AirtableDisbursementResponse, err
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := airtableClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -709,7 +2114,7 @@ func createDisbursement(event AirtableEvent) (*AirtableDisbursementResponse, err
 	return &response, nil
 }
 
-func sendHCBTransfer(event AirtableEvent, disbursementID int) error {
+func sendHCBTransfer(ctx context.Context, event AirtableEvent, name string) (*HCBTransferResponse, error) {
 	token := os.Getenv("HCB_API_TOKEN")
 
 	var transfer HCBTransferRequest
@@ -719,62 +2124,95 @@ func sendHCBTransfer(event AirtableEvent, disbursementID int) error {
 		// Negative amount - withdrawal from event to Campfire
 		transfer = HCBTransferRequest{
 			ToOrganizationID: "campfire",
-			Name:             fmt.Sprintf("Campfire signup withdrawal ID %d", disbursementID),
-			AmountCents:      int(-event.Fields.AmountOwed * 100), // Make positive for transfer amount
+			Name:             name,
+			AmountCents:      int(math.Round(-event.Fields.AmountOwed * 100)), // Make positive for transfer amount
 		}
 		url = fmt.Sprintf("https://hcb.hackclub.com/api/v4/organizations/%s/transfers/", event.Fields.HCBEventID)
 	} else {
 		// Positive amount - grant from Campfire to event
 		transfer = HCBTransferRequest{
 			ToOrganizationID: event.Fields.HCBEventID,
-			Name:             fmt.Sprintf("Campfire signup grant ID %d", disbursementID),
-			AmountCents:      int(event.Fields.AmountOwed * 100), // Convert to cents
+			Name:             name,
+			AmountCents:      int(math.Round(event.Fields.AmountOwed * 100)), // Convert to cents
 		}
 		url = "https://hcb.hackclub.com/api/v4/organizations/campfire/transfers/"
 	}
 
 	jsonData, err := json.Marshal(transfer)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := hcbClient.Do(req)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("HCB request failed (%v): %w", err, errTransferUnknown)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("HCB response could not be read (status %d, %v): %w", resp.StatusCode, err, errTransferUnknown)
 	}
 
+	// A server error may come after HCB committed the transfer
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("HCB server error (status %d): %s: %w", resp.StatusCode, string(body), errTransferUnknown)
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("HCB API error (status %d): %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("HCB API error (status %d): %s", resp.StatusCode, string(body))
 	}
 
-	log.Printf("HCB transfer successful: %s", string(body))
-	return nil
+	return parseHCBTransfer(ctx, body, "HCB transfer successful"), nil
+}
+
+// parseHCBTransfer reads the transfer HCB created. The money has already
+// moved, so a body that cannot be read is logged rather than failing the
+// disbursement.
+func parseHCBTransfer(ctx context.Context, body []byte, message string) *HCBTransferResponse {
+	var transfer HCBTransferResponse
+	if err := json.Unmarshal(body, &transfer); err != nil || transfer.ID == "" {
+		slog.WarnContext(ctx, "Could not read the HCB transfer ID", "response", string(body), "error", err)
+	}
+	slog.InfoContext(ctx, message, "hcb_transfer_id", transfer.ID, "hcb_transfer_status", transfer.Status)
+	return &transfer
+}
+
+func updateDisbursementStatus(ctx context.Context, disbursementID, status, notes string) error {
+	return updateDisbursement(ctx, disbursementID, map[string]interface{}{
+		"status": status,
+		"notes":  notes,
+	})
+}
+
+// updateSubmittedDisbursement records the HCB transfer a disbursement
+// created. The status is submitted until pollTransfers sees HCB settle it,
+// unless HCB already reported a final state.
+func updateSubmittedDisbursement(ctx context.Context, progress *RunResult, notes string) error {
+	if progress.HCBTransferID != "" {
+		notes += fmt.Sprintf(". HCB transfer %s (%s)", progress.HCBTransferID, progress.HCBTransferStatus)
+	}
+	return updateDisbursement(ctx, progress.DisbursementRecordID, map[string]interface{}{
+		"status":              transferState(progress.HCBTransferStatus),
+		"notes":               notes,
+		"hcb_transfer_id":     progress.HCBTransferID,
+		"hcb_transfer_status": progress.HCBTransferStatus,
+	})
 }
 
-func updateDisbursementStatus(disbursementID, status, notes string) error {
+func updateDisbursement(ctx context.Context, disbursementID string, fields map[string]interface{}) error {
 	baseID := os.Getenv("AIRTABLE_BASE_ID")
 	apiKey := os.Getenv("AIRTABLE_API_KEY")
 
 	update := map[string]interface{}{
-		"fields": map[string]interface{}{
-			"status": status,
-			"notes":  notes,
-		},
+		"fields": fields,
 	}
 
 	jsonData, err := json.Marshal(update)
@@ -783,7 +2221,7 @@ func updateDisbursementStatus(disbursementID, status, notes string) error {
 	}
 
 	url := fmt.Sprintf("https://api.airtable.com/v0/%s/disbursements/%s", baseID, disbursementID)
-	req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "PATCH", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
@@ -791,8 +2229,7 @@ func updateDisbursementStatus(disbursementID, status, notes string) error {
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := airtableClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -810,45 +2247,84 @@ func updateDisbursementStatus(disbursementID, status, notes string) error {
 	return nil
 }
 
-func processCustomDisbursement(event AirtableEvent, customAmount float64) error {
-	log.Printf("Processing custom disbursement for event %s (HCB ID: %s, Custom Amount: $%.2f)", 
-		event.ID, event.Fields.HCBEventID, customAmount)
+func processCustomDisbursement(ctx context.Context, event AirtableEvent, customAmount float64, text TransferText, progress *RunResult, checkpoint func()) error {
+	if progress.Step == stepPlanned {
+		slog.InfoContext(ctx, "Processing custom disbursement", "amount", customAmount)
 
-	// Create disbursement in Airtable with custom amount
-	disbursement, err := createCustomDisbursement(event, customAmount)
-	if err != nil {
-		return fmt.Errorf("failed to create custom disbursement: %v", err)
+		// Create disbursement in Airtable with custom amount
+		disbursement, err := createCustomDisbursement(ctx, event, customAmount)
+		if err != nil {
+			return fmt.Errorf("failed to create custom disbursement: %v", err)
+		}
+		progress.DisbursementRecordID = disbursement.ID
+		progress.DisbursementID = disbursement.Fields.DisbursementID
+		progress.Step = stepRecordCreated
+		checkpoint()
+		slog.InfoContext(withLogAttrs(ctx, "disbursement_id", progress.DisbursementID), "Created custom disbursement", "disbursement_record_id", disbursement.ID)
 	}
 
-	log.Printf("Created custom disbursement %d for event %s", 
-		disbursement.Fields.DisbursementID, event.ID)
-
-	// Send to HCB with custom amount
-	err = sendCustomHCBTransfer(event, disbursement.Fields.DisbursementID, customAmount)
-	if err != nil {
-		// Update disbursement as failed
-		notes := fmt.Sprintf("HCB custom transfer failed: %v. Created at %s", err, time.Now().Format("2006-01-02 15:04:05 MST"))
-		updateErr := updateDisbursementStatus(disbursement.ID, "failed", notes)
-		if updateErr != nil {
-			log.Printf("Failed to update disbursement status: %v", updateErr)
+	ctx = withLogAttrs(ctx, "disbursement_id", progress.DisbursementID)
+	text.DisbursementID = progress.DisbursementID
+
+	switch progress.Step {
+	case stepRecordCreated:
+		// Saved before sending so a crash mid-request is never resent
+		progress.Step = stepTransferStarted
+		checkpoint()
+
+		// Send to HCB with custom amount
+		transfer, err := sendCustomHCBTransfer(ctx, event, text.name(), customAmount)
+		if errors.Is(err, errTransferUnknown) {
+			// The transfer may exist; stay at transfer_started so it is
+			// never sent again
+			return err
+		}
+		if err != nil {
+			progress.Step = stepTransferFailed
+			checkpoint()
+
+			// Update disbursement as failed
+			notes := text.withMemo(fmt.Sprintf("HCB custom transfer failed: %v. Created at %s", err, time.Now().Format("2006-01-02 15:04:05 MST")))
+			updateErr := updateDisbursementStatus(ctx, progress.DisbursementRecordID, "failed", notes)
+			if updateErr != nil {
+				slog.ErrorContext(ctx, "Failed to update disbursement status", "error", updateErr)
+			}
+			return fmt.Errorf("HCB custom transfer failed: %v", err)
 		}
-		return fmt.Errorf("HCB custom transfer failed: %v", err)
+		progress.HCBTransferID = transfer.ID
+		progress.HCBTransferStatus = transfer.Status
+		progress.Step = stepTransferSent
+		checkpoint()
+	case stepTransferFailed:
+		return resumeFailedTransfer(ctx, progress, text)
+	case stepTransferStarted:
+		return errTransferUnknown
 	}
 
-	// Update disbursement as processed
-	notes := fmt.Sprintf("Successfully processed custom HCB transfer. Sent $%.2f to organization %s. Completed at %s", 
-		customAmount, event.Fields.HCBEventID, time.Now().Format("2006-01-02 15:04:05 MST"))
-	err = updateDisbursementStatus(disbursement.ID, "processed", notes)
-	if err != nil {
-		log.Printf("Failed to update disbursement status: %v", err)
-		return err
+	if progress.Step == stepTransferSent {
+		// Update disbursement as processed
+		var notes string
+		if customAmount < 0 {
+			notes = fmt.Sprintf("Successfully processed custom HCB clawback. Received $%.2f from organization %s. Completed at %s", 
+				-customAmount, event.Fields.HCBEventID, time.Now().Format("2006-01-02 15:04:05 MST"))
+		} else {
+			notes = fmt.Sprintf("Successfully processed custom HCB transfer. Sent $%.2f to organization %s. Completed at %s", 
+				customAmount, event.Fields.HCBEventID, time.Now().Format("2006-01-02 15:04:05 MST"))
+		}
+		err := updateSubmittedDisbursement(ctx, progress, text.withMemo(notes))
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to update disbursement status", "error", err)
+			return err
+		}
+		progress.Step = stepStatusUpdated
+		checkpoint()
 	}
 
-	log.Printf("Successfully completed custom disbursement %d", disbursement.Fields.DisbursementID)
+	slog.InfoContext(ctx, "Successfully completed custom disbursement")
 	return nil
 }
 
-func createCustomDisbursement(event AirtableEvent, customAmount float64) (*AirtableDisbursementResponse, error) {
+func createCustomDisbursement(ctx context.Context, event AirtableEvent, customAmount float64) (*AirtableDisbursementResponse, error) {
 	baseID := os.Getenv("AIRTABLE_BASE_ID")
 	apiKey := os.Getenv("AIRTABLE_API_KEY")
 
@@ -863,7 +2339,7 @@ func createCustomDisbursement(event AirtableEvent, customAmount float64) (*Airta
 			AssociatedEvent:  []string{event.ID},
 			Amount:           customAmount,
 			Status:           "pending",
-			DisbursementType: "miscellaneous",
+			DisbursementType: disbursementTypeFor("custom", customAmount),
 			Notes:            fmt.Sprintf("Custom disbursement created for event %s at %s", event.ID, time.Now().Format("2006-01-02 15:04:05 MST")),
 		},
 	}
@@ -874,7 +2350,7 @@ func createCustomDisbursement(event AirtableEvent, customAmount float64) (*Airta
 	}
 
 	url := fmt.Sprintf("https://api.airtable.com/v0/%s/disbursements", baseID)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, err
 	}
@@ -882,8 +2358,7 @@ func createCustomDisbursement(event AirtableEvent, customAmount float64) (*Airta
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := airtableClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -907,45 +2382,60 @@ func createCustomDisbursement(event AirtableEvent, customAmount float64) (*Airta
 	return &response, nil
 }
 
-func sendCustomHCBTransfer(event AirtableEvent, disbursementID int, customAmount float64) error {
+func sendCustomHCBTransfer(ctx context.Context, event AirtableEvent, name string, customAmount float64) (*HCBTransferResponse, error) {
 	token := os.Getenv("HCB_API_TOKEN")
 
-	transfer := HCBTransferRequest{
-		ToOrganizationID: event.Fields.HCBEventID,
-		Name:             fmt.Sprintf("Campfire miscellaneous disbursement %d", disbursementID),
-		AmountCents:      int(customAmount * 100), // Convert to cents
+	var transfer HCBTransferRequest
+	var url string
+
+	if customAmount < 0 {
+		// Clawback - withdrawal from event to Campfire
+		transfer = HCBTransferRequest{
+			ToOrganizationID: "campfire",
+			Name:             name,
+			AmountCents:      int(math.Round(-customAmount * 100)), // Make positive for transfer amount
+		}
+		url = fmt.Sprintf("https://hcb.hackclub.com/api/v4/organizations/%s/transfers/", event.Fields.HCBEventID)
+	} else {
+		transfer = HCBTransferRequest{
+			ToOrganizationID: event.Fields.HCBEventID,
+			Name:             name,
+			AmountCents:      int(math.Round(customAmount * 100)), // Convert to cents
+		}
+		url = "https://hcb.hackclub.com/api/v4/organizations/campfire/transfers/"
 	}
-	url := "https://hcb.hackclub.com/api/v4/organizations/campfire/transfers/"
 
 	jsonData, err := json.Marshal(transfer)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := hcbClient.Do(req)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("HCB request failed (%v): %w", err, errTransferUnknown)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("HCB response could not be read (status %d, %v): %w", resp.StatusCode, err, errTransferUnknown)
 	}
 
+	// A server error may come after HCB committed the transfer
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("HCB server error (status %d): %s: %w", resp.StatusCode, string(body), errTransferUnknown)
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("HCB API error (status %d): %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("HCB API error (status %d): %s", resp.StatusCode, string(body))
 	}
 
-	log.Printf("HCB custom transfer successful: %s", string(body))
-	return nil
+	return parseHCBTransfer(ctx, body, "HCB custom transfer successful"), nil
 }
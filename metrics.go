@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	transfersAttempted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cash_cannon_transfers_attempted_total",
+		Help: "Disbursements attempted, by disbursement type.",
+	}, []string{"type"})
+
+	transfersCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cash_cannon_transfers_total",
+		Help: "Disbursements finished, by disbursement type and result (succeeded, failed or unknown).",
+	}, []string{"type", "result"})
+
+	dollarsMoved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cash_cannon_dollars_moved_total",
+		Help: "Absolute dollars moved by successful disbursements, by disbursement type.",
+	}, []string{"type"})
+
+	upstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cash_cannon_upstream_request_duration_seconds",
+		Help:    "Latency of Airtable and HCB API requests, by service, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "method", "status"})
+
+	rateLimitWaits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cash_cannon_rate_limit_waits_total",
+		Help: "Times a request was rate limited (HTTP 429) and retried, by service.",
+	}, []string{"service"})
+
+	rateLimitWaitSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cash_cannon_rate_limit_wait_seconds_total",
+		Help: "Total time spent waiting out rate limits, by service.",
+	}, []string{"service"})
+
+	runDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cash_cannon_run_duration_seconds",
+		Help:    "Duration of disbursement runs, by mode.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 3600},
+	}, []string{"mode"})
+)
+
+// hcbTimeout bounds an HCB call, including its rate-limit retries. Runs
+// ignore request cancellation, so without it a hung transfer request would
+// hold the run, and shutdown, forever. A transfer that times out is recorded
+// as unknown, not failed.
+const hcbTimeout = 2 * time.Minute
+
+// airtableTimeout bounds an Airtable call the same way, leaving room for the
+// 30-second rate-limit waits. A hung record update would otherwise hold the
+// run lock and block shutdown.
+const airtableTimeout = 2 * time.Minute
+
+var (
+	airtableClient = &http.Client{Timeout: airtableTimeout, Transport: &instrumentedTransport{service: "airtable", base: tracedTransport("airtable")}}
+	hcbClient      = &http.Client{Timeout: hcbTimeout, Transport: &instrumentedTransport{service: "hcb", base: tracedTransport("hcb")}}
+)
+
+const (
+	rateLimitMaxRetries  = 3
+	rateLimitDefaultWait = 30 * time.Second // Airtable asks clients to back off 30 seconds after a 429
+)
+
+// instrumentedTransport records request latency and status codes, and waits
+// out 429 responses (honouring Retry-After) before retrying the request.
+type instrumentedTransport struct {
+	service string
+	base    http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := t.base.RoundTrip(req)
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(resp.StatusCode)
+		}
+		upstreamRequestDuration.WithLabelValues(t.service, req.Method, status).Observe(time.Since(start).Seconds())
+
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt == rateLimitMaxRetries {
+			return resp, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+
+		wait := rateLimitDefaultWait
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		}
+		resp.Body.Close()
+
+		slog.WarnContext(req.Context(), "Rate limited, retrying", "service", t.service, "method", req.Method,
+			"path", req.URL.Path, "wait", wait.String())
+		rateLimitWaits.WithLabelValues(t.service).Inc()
+		rateLimitWaitSeconds.WithLabelValues(t.service).Add(wait.Seconds())
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			retry.Body = body
+		}
+		req = retry
+	}
+}
+
+// recordTransferAttempt counts an event when a run first starts on it, not
+// again when the run is resumed.
+func recordTransferAttempt(mode string, amount float64) {
+	transfersAttempted.WithLabelValues(disbursementTypeFor(mode, amount)).Inc()
+}
+
+func recordTransferMetrics(mode string, result RunResult) {
+	disbursementType := disbursementTypeFor(mode, result.Amount)
+	if result.Status != "processed" {
+		transfersCompleted.WithLabelValues(disbursementType, result.Status).Inc()
+		return
+	}
+	transfersCompleted.WithLabelValues(disbursementType, "succeeded").Inc()
+	dollarsMoved.WithLabelValues(disbursementType).Add(math.Abs(result.Amount))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Run lifecycle notifications go to the Slack incoming webhook in
+// SLACK_WEBHOOK_URL. Without it they are only logged. For local testing,
+// point SLACK_WEBHOOK_URL at `cash-cannon webhook-sink`.
+
+func notifyRunStarted(ctx context.Context, run *Run) {
+	if len(run.Results) > 0 {
+		postSlack(ctx, fmt.Sprintf(":arrow_forward: Run `%s` resumed at event %d of %d",
+			run.ID, run.completedEvents()+1, len(run.Plan.Items)))
+		return
+	}
+	postSlack(ctx, fmt.Sprintf(":rocket: Run `%s` started: %d %s disbursements totalling $%.2f (source: %s%s)",
+		run.ID, len(run.Plan.Items), run.Mode, run.Plan.TotalAmount, run.Source, operatorSuffix(run.Operator)))
+}
+
+func notifyRunCompleted(ctx context.Context, run *Run) {
+	processedAmount, failedAmount := 0.0, 0.0
+	for _, result := range run.Results {
+		if result.Status == "processed" {
+			processedAmount += math.Abs(result.Amount)
+		} else {
+			failedAmount += math.Abs(result.Amount)
+		}
+	}
+
+	icon := ":white_check_mark:"
+	if run.Failed > 0 {
+		icon = ":warning:"
+	}
+	postSlack(ctx, fmt.Sprintf("%s Run `%s` completed: created %d, processed %d ($%.2f), failed %d ($%.2f)",
+		icon, run.ID, run.Created, run.Processed, processedAmount, run.Failed, failedAmount))
+}
+
+func notifyDisbursementFailed(ctx context.Context, run *Run, result RunResult) {
+	disbursement := "no disbursement record"
+	if result.DisbursementID != 0 {
+		disbursement = fmt.Sprintf("disbursement %d", result.DisbursementID)
+	}
+	postSlack(ctx, fmt.Sprintf(":x: Run `%s`: $%.2f %s to `%s` failed (%s)\n```%s```",
+		run.ID, math.Abs(result.Amount), result.Direction, result.HCBEventID, disbursement, result.Error))
+}
+
+func notifyPendingApproval(ctx context.Context, run *Run) {
+	text := fmt.Sprintf(":hourglass: Scheduled run `%s` is awaiting approval: %d disbursements totalling $%.2f",
+		run.ID, len(run.Plan.Items), run.Plan.TotalAmount)
+	if len(run.PolicyViolations) > 0 {
+		text += "\n• " + strings.Join(run.PolicyViolations, "\n• ")
+	}
+	postSlack(ctx, text)
+}
+
+func operatorSuffix(operator string) string {
+	if operator == "" {
+		return ""
+	}
+	return ", operator: " + operator
+}
+
+// postSlack sends text to the Slack webhook. Notification failures are logged
+// and never interrupt a run.
+func postSlack(ctx context.Context, text string) {
+	slog.InfoContext(ctx, "Notification", "text", text)
+
+	webhookURL := os.Getenv("SLACK_WEBHOOK_URL")
+	if webhookURL == "" {
+		return
+	}
+
+	jsonData, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode Slack notification", "error", err)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to send Slack notification", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to send Slack notification", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		slog.ErrorContext(ctx, "Slack webhook error", "status", resp.StatusCode, "response", string(body))
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The OpenAPI spec is generated from apiV1Routes and the Go types the
+// handlers encode, so it cannot drift from what the API actually does.
+// Named struct types become component schemas; a field is required unless
+// its JSON tag has omitempty.
+var pathParamPattern = regexp.MustCompile(`:([A-Za-z_]+)`)
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func handleOpenAPI(c *gin.Context) {
+	c.JSON(200, openAPISpec())
+}
+
+func openAPISpec() map[string]interface{} {
+	schemas := schemaSet{}
+	errorResponse := schemas.ref(reflect.TypeOf(APIErrorResponse{}))
+
+	paths := make(map[string]map[string]interface{})
+	for _, route := range apiV1Routes() {
+		path := pathParamPattern.ReplaceAllString(route.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+
+		var params []interface{}
+		for _, match := range pathParamPattern.FindAllStringSubmatch(route.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": match[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, param := range route.Query {
+			params = append(params, map[string]interface{}{
+				"name": param.Name, "in": "query", "description": param.Description, "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+
+		responses := map[string]interface{}{
+			strconv.Itoa(route.Status): map[string]interface{}{
+				"description": http.StatusText(route.Status),
+				"content":     jsonContent(schemas.ref(reflect.TypeOf(route.Response))),
+			},
+		}
+		for _, status := range append([]int{401, 403}, route.Errors...) {
+			responses[strconv.Itoa(status)] = map[string]interface{}{
+				"description": http.StatusText(status),
+				"content":     jsonContent(errorResponse),
+			}
+		}
+
+		operation := map[string]interface{}{
+			"operationId": operationID(route),
+			"summary":     route.Summary,
+			"description": "Needs an API token with the " + route.Scope + " scope, or basic auth.",
+			"x-scope":     route.Scope,
+			"responses":   responses,
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if route.Body != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(schemas.ref(reflect.TypeOf(route.Body))),
+			}
+		}
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "cash-cannon",
+			"version": "1",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/api/v1"}},
+		"security": []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+			map[string]interface{}{"basicAuth": []string{}},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "description": "An API token (cc_…) from the dashboard's tokens page"},
+				"basicAuth":  map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+		},
+	}
+}
+
+// operationID names an operation from its method and path, e.g.
+// post_runs_id_approve.
+func operationID(route apiRoute) string {
+	parts := []string{strings.ToLower(route.Method)}
+	for _, part := range strings.Split(route.Path, "/") {
+		part = strings.TrimPrefix(part, ":")
+		part = strings.TrimSuffix(part, ".json")
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// schemaSet collects the component schemas, by Go type name.
+type schemaSet map[string]interface{}
+
+// ref returns the schema for t, registering named structs as components.
+func (s schemaSet) ref(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		if _, ok := s[t.Name()]; !ok {
+			s[t.Name()] = nil // placeholder for recursive types
+			s[t.Name()] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.ref(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.ref(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+// object builds the schema of a struct, flattening embedded structs the way
+// encoding/json does.
+func (s schemaSet) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	s.addFields(t, properties, &required)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (s schemaSet) addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			s.addFields(field.Type, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.ref(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
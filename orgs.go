@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Every organization a plan sends to is looked up on HCB while the plan is
+// built, so a mistyped hcb_event_id is blocked in the preview instead of
+// failing after its disbursement record was created. Lookups are cached for
+// orgCacheTTL; errors other than "not found" are not cached.
+const (
+	orgCacheTTL     = 10 * time.Minute
+	orgLookupWorker = 8
+)
+
+var errOrgNotFound = errors.New("organization not found on HCB")
+
+// HCBOrganization is the part of HCB's organization response we use.
+type HCBOrganization struct {
+	ID       string `json:"id"`
+	Slug     string `json:"slug"`
+	Name     string `json:"name"`
+	Archived bool   `json:"archived"`
+}
+
+type orgCacheEntry struct {
+	org       *HCBOrganization
+	err       error
+	fetchedAt time.Time
+}
+
+var orgCache = struct {
+	mu      sync.Mutex
+	entries map[string]orgCacheEntry
+}{entries: make(map[string]orgCacheEntry)}
+
+// resolveOrganizations looks up every distinct slug, a few at a time, and
+// returns the result for each.
+func resolveOrganizations(ctx context.Context, slugs []string) map[string]orgCacheEntry {
+	results := make(map[string]orgCacheEntry)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+
+	for i := 0; i < orgLookupWorker; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for slug := range queue {
+				org, err := resolveOrganization(ctx, slug)
+				mu.Lock()
+				results[slug] = orgCacheEntry{org: org, err: err}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	seen := make(map[string]bool)
+	for _, slug := range slugs {
+		if !seen[slug] {
+			seen[slug] = true
+			queue <- slug
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
+// resolveOrganization returns the organization for slug, or errOrgNotFound.
+func resolveOrganization(ctx context.Context, slug string) (*HCBOrganization, error) {
+	orgCache.mu.Lock()
+	entry, ok := orgCache.entries[slug]
+	orgCache.mu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < orgCacheTTL {
+		return entry.org, entry.err
+	}
+
+	org, err := getHCBOrganization(ctx, slug)
+	if err != nil && !errors.Is(err, errOrgNotFound) {
+		slog.WarnContext(ctx, "Failed to look up HCB organization", "hcb_event_id", slug, "error", err)
+		return nil, err
+	}
+
+	orgCache.mu.Lock()
+	orgCache.entries[slug] = orgCacheEntry{org: org, err: err, fetchedAt: time.Now()}
+	orgCache.mu.Unlock()
+	return org, err
+}
+
+func getHCBOrganization(ctx context.Context, slug string) (*HCBOrganization, error) {
+	u := "https://hcb.hackclub.com/api/v4/organizations/" + url.PathEscape(slug)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("HCB_API_TOKEN"))
+
+	resp, err := hcbClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == 404 {
+		return nil, errOrgNotFound
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("HCB API error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var org HCBOrganization
+	if err := json.Unmarshal(body, &org); err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
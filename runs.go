@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RunStore keeps the run history under DATA_DIR, one JSON file per run, so
+// the dashboard and the CLI see the same runs and a checkpoint rewrites only
+// its own run. Writes hold a file lock, shared with other processes, so
+// Update can check a run's state and change it atomically.
+type RunStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+var runStore = &RunStore{dir: filepath.Join(dataDir(), "runs")}
+
+// errNotFound is wrapped by the stores' Get when no record has the ID.
+var errNotFound = errors.New("not found")
+
+// runStateError is returned when a run is not in the state an action needs,
+// e.g. because another operator approved it first. The API answers it with
+// 409.
+type runStateError struct {
+	message string
+}
+
+func (err *runStateError) Error() string {
+	return err.message
+}
+
+// wrongStatus is the runStateError for a run whose status is not want.
+func wrongStatus(id, status, want string) *runStateError {
+	return &runStateError{fmt.Sprintf("run %s is %s, not %s", id, status, strings.ReplaceAll(want, "_", " "))}
+}
+
+// errAirtable marks a failure that came from Airtable rather than from the
+// run history, so the API can answer it with 502.
+var errAirtable = errors.New("airtable request failed")
+
+var runIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func dataDir() string {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		dir = "data"
+	}
+	return dir
+}
+
+// List returns every recorded run, newest first.
+func (s *RunStore) List() ([]Run, error) {
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Run{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	runs := []Run{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		var run Run
+		if err := readJSONFile(filepath.Join(s.dir, entry.Name()), &run); err != nil {
+			return nil, err
+		}
+		if run.ID != "" {
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID > runs[j].ID })
+	return runs, nil
+}
+
+func (s *RunStore) Get(id string) (*Run, error) {
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	return s.read(id)
+}
+
+// Save writes the run, replacing the stored copy with the same ID.
+func (s *RunStore) Save(run *Run) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeJSONFile(s.path(run.ID), run)
+}
+
+// Update applies fn to the stored run and saves the result, holding the lock
+// throughout so no other goroutine or process changes the run in between.
+// If fn fails nothing is saved.
+func (s *RunStore) Update(id string, fn func(*Run) error) (*Run, error) {
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	run, err := s.read(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(run); err != nil {
+		return nil, err
+	}
+	if err := writeJSONFile(s.path(run.ID), run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+func (s *RunStore) read(id string) (*Run, error) {
+	if !runIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("run %s %w", id, errNotFound)
+	}
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("run %s %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (s *RunStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// lock takes the in-process mutex and the store's file lock.
+func (s *RunStore) lock() (func(), error) {
+	s.mu.Lock()
+	unlock, err := lockFile(filepath.Join(s.dir, ".lock"))
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		s.mu.Unlock()
+	}, nil
+}
+
+// migrate splits the single runs.json used by earlier versions into one
+// file per run, then renames it to runs.json.migrated.
+func (s *RunStore) migrate() error {
+	legacy := filepath.Join(filepath.Dir(s.dir), "runs.json")
+	if _, err := os.Stat(legacy); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var runs []Run
+	if err := readJSONFile(legacy, &runs); err != nil {
+		return err
+	}
+	for i := range runs {
+		if _, err := os.Stat(s.path(runs[i].ID)); err == nil {
+			continue
+		}
+		if err := writeJSONFile(s.path(runs[i].ID), &runs[i]); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(legacy, legacy+".migrated"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// readJSONFile decodes path into v, leaving v untouched if the file does not
+// exist yet.
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONFile replaces path atomically so a crash mid-write never leaves a
+// truncated file behind. Readers never need a lock; writers that read the
+// file first must hold its lock so another process cannot write in between.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Scheduled autogrants are configured with:
+//
+//	AUTOGRANT_SCHEDULE        cron expression, e.g. "0 9 * * 1" or "CRON_TZ=America/New_York @daily"
+//	AUTOGRANT_AUTO_EXECUTE    "true" to send plans that are within the policy limits
+//	AUTOGRANT_MAX_TOTAL       largest plan total (absolute dollars) that may run unattended
+//	AUTOGRANT_MAX_PER_EVENT   largest single disbursement (absolute dollars) that may run unattended
+//
+// Plans that are not auto-executed wait in the run history for an operator
+// to approve or reject them from the dashboard.
+
+// startScheduler registers the autogrant schedule, if one is configured, and
+// the HCB transfer status poll. It returns nil when neither is enabled.
+func startScheduler() (*cron.Cron, error) {
+	c := cron.New()
+
+	if spec := os.Getenv("AUTOGRANT_SCHEDULE"); spec != "" {
+		if _, err := c.AddFunc(spec, scheduledAutogrant); err != nil {
+			return nil, fmt.Errorf("invalid AUTOGRANT_SCHEDULE %q: %v", spec, err)
+		}
+		slog.Info("Scheduled autogrant runs enabled", "schedule", spec)
+	}
+
+	if spec := transferPollSchedule(); spec != "" {
+		if _, err := c.AddFunc(spec, scheduledTransferPoll); err != nil {
+			return nil, fmt.Errorf("invalid TRANSFER_POLL_SCHEDULE %q: %v", spec, err)
+		}
+		slog.Info("HCB transfer status polling enabled", "schedule", spec)
+	}
+
+	if len(c.Entries()) == 0 {
+		return nil, nil
+	}
+	c.Start()
+	return c, nil
+}
+
+func scheduledAutogrant() {
+	ctx := withLogAttrs(context.Background(), "user", "scheduler")
+	slog.InfoContext(ctx, "Starting scheduled autogrant plan")
+
+	events, err := getAllEvents(ctx, EventTarget{})
+	if err != nil {
+		slog.ErrorContext(ctx, "Scheduled autogrant: error fetching events", "error", err)
+		return
+	}
+
+	if err := supersedePendingRuns(ctx); err != nil {
+		slog.ErrorContext(ctx, "Scheduled autogrant: failed to supersede pending runs", "error", err)
+	}
+
+	run := newRun(buildAutograntPlan(ctx, events), "scheduler", "")
+	ctx = withLogAttrs(ctx, "run_id", run.ID)
+	if len(run.Plan.Items) == 0 {
+		run.Status = "skipped"
+		run.FinishedAt = &run.CreatedAt
+		if err := runStore.Save(run); err != nil {
+			slog.ErrorContext(ctx, "Failed to record run", "error", err)
+		}
+		slog.InfoContext(ctx, "Scheduled autogrant: nothing owed, run skipped")
+		return
+	}
+
+	run.PolicyViolations = checkAutograntPolicy(run.Plan)
+	if os.Getenv("AUTOGRANT_AUTO_EXECUTE") == "true" && len(run.PolicyViolations) == 0 {
+		err := startRun(ctx, run, replanAutogrant)
+		var changed *planChangedError
+		switch {
+		case errors.As(err, &changed):
+			// A dashboard or CLI run paid some of these balances while this
+			// one waited; the next scheduled run picks up what is left.
+			run.Status = "expired"
+			if err := runStore.Save(run); err != nil {
+				slog.ErrorContext(ctx, "Failed to record run", "error", err)
+			}
+			return
+		case err == nil:
+			return
+		}
+		slog.ErrorContext(ctx, "Scheduled autogrant: could not start the run; leaving it for approval", "error", err)
+	}
+
+	run.Status = "awaiting_approval"
+	if err := runStore.Save(run); err != nil {
+		slog.ErrorContext(ctx, "Failed to record run", "error", err)
+		return
+	}
+	notifyPendingApproval(ctx, run)
+}
+
+// checkAutograntPolicy returns the reasons a plan may not run unattended.
+// Auto-execution always needs AUTOGRANT_MAX_TOTAL so an unexpected spike in
+// amount_owed can never go out without a human looking at it.
+func checkAutograntPolicy(plan Plan) []string {
+	var violations []string
+
+	maxTotal, err := parseAmount(os.Getenv("AUTOGRANT_MAX_TOTAL"))
+	if err != nil {
+		violations = append(violations, "AUTOGRANT_MAX_TOTAL is not set")
+	}
+
+	total := 0.0
+	for _, item := range plan.Items {
+		total += math.Abs(item.Amount)
+	}
+	if err == nil && total > maxTotal {
+		violations = append(violations, fmt.Sprintf("total $%.2f exceeds limit of $%.2f", total, maxTotal))
+	}
+
+	if limit := os.Getenv("AUTOGRANT_MAX_PER_EVENT"); limit != "" {
+		maxPerEvent, err := parseAmount(limit)
+		if err != nil {
+			violations = append(violations, "AUTOGRANT_MAX_PER_EVENT is not a number")
+		} else {
+			for _, item := range plan.Items {
+				if math.Abs(item.Amount) > maxPerEvent {
+					violations = append(violations, fmt.Sprintf("%s: $%.2f exceeds per-event limit of $%.2f",
+						item.HCBEventID, math.Abs(item.Amount), maxPerEvent))
+				}
+			}
+		}
+	}
+
+	return violations
+}
+
+// supersedePendingRuns retires scheduled plans nobody approved, so two
+// overlapping plans for the same balances can never both be sent.
+func supersedePendingRuns(ctx context.Context) error {
+	runs, err := runStore.List()
+	if err != nil {
+		return err
+	}
+	for i := range runs {
+		if runs[i].Status != "awaiting_approval" {
+			continue
+		}
+		_, err := claimRun(runs[i].ID, "awaiting_approval", func(run *Run) { run.Status = "superseded" })
+		var stateErr *runStateError
+		if errors.As(err, &stateErr) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Run superseded by a newer scheduled plan", "superseded_run_id", runs[i].ID)
+	}
+	return nil
+}
+
+// claimRun atomically moves a run from one status to another, so of two
+// operators (or an operator and the server) acting on the same run only one
+// wins. The loser gets a *runStateError naming the run's current status.
+func claimRun(id, from string, fn func(*Run)) (*Run, error) {
+	return runStore.Update(id, func(run *Run) error {
+		if run.Status != from {
+			return wrongStatus(id, run.Status, from)
+		}
+		fn(run)
+		return nil
+	})
+}
+
+// approveRun executes a plan that was awaiting approval. The run is claimed
+// first, so a second approval is refused, and the events are fetched again
+// once the run lock is held: if any balance changed since the plan was made,
+// by a run since or one that held the lock, the plan is stale and the run is
+// expired instead of being sent. If the plan could not be checked the run
+// goes back to awaiting approval.
+func approveRun(ctx context.Context, id, operator string) (*Run, error) {
+	ctx = withLogAttrs(ctx, "run_id", id)
+
+	run, err := claimRun(id, "awaiting_approval", func(run *Run) {
+		run.Status = "running"
+		run.ApprovedBy = operator
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = startRun(ctx, run, replanAutogrant)
+	if err == nil {
+		return run, nil
+	}
+	status := "awaiting_approval"
+	var changed *planChangedError
+	if errors.As(err, &changed) {
+		status = "expired"
+		slog.WarnContext(ctx, "Run expired: balances changed since it was planned")
+	}
+	if _, updateErr := claimRun(id, "running", func(run *Run) {
+		run.Status = status
+		if status == "awaiting_approval" {
+			run.ApprovedBy = ""
+		}
+	}); updateErr != nil {
+		slog.ErrorContext(ctx, "Failed to record run", "error", updateErr)
+	}
+	return nil, fmt.Errorf("run %s was not sent: %w", id, err)
+}
+
+// replanAutogrant builds the autogrant plan from live amount_owed, for
+// startRun to compare a scheduled plan with.
+func replanAutogrant(ctx context.Context) (Plan, error) {
+	events, err := getAllEvents(ctx, EventTarget{})
+	if err != nil {
+		return Plan{}, err
+	}
+	return buildAutograntPlan(ctx, events), nil
+}
+
+func rejectRun(ctx context.Context, id, operator string) (*Run, error) {
+	run, err := claimRun(id, "awaiting_approval", func(run *Run) {
+		run.Status = "rejected"
+		run.ApprovedBy = operator
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Run rejected", "run_id", run.ID)
+	return run, nil
+}
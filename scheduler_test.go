@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// TestApproveRunRechecksBalances approves a scheduled plan after its balance
+// was paid by another run and checks that it is expired, not sent.
+func TestApproveRunRechecksBalances(t *testing.T) {
+	tests := []struct {
+		name   string
+		owed   float64
+		status string
+		sent   int
+	}{
+		{"unchanged", 25, "completed", 1},
+		{"paid since", 0, "expired", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newStubUpstream(t)
+			stub.responses = map[string]interface{}{
+				"/v0/appTest/events": map[string]interface{}{"records": []interface{}{
+					map[string]interface{}{"id": "recEvent0000001", "fields": map[string]interface{}{"hcb_event_id": "hq", "amount_owed": tt.owed}},
+				}},
+				"/api/v4/organizations/hq": map[string]interface{}{"id": "org_hq", "name": "HQ"},
+			}
+
+			item := PlanItem{RecordID: "recEvent0000001", HCBEventID: "hq", Amount: 25, Direction: "grant"}
+			run := newRun(Plan{Mode: "autogrant", Items: []PlanItem{item}, EventCount: 1, TotalAmount: 25}, "scheduler", "")
+			run.Status = "awaiting_approval"
+			if err := runStore.Save(run); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := approveRun(context.Background(), run.ID, "test")
+			var changed *planChangedError
+			if errors.As(err, &changed) != (tt.sent == 0) {
+				t.Errorf("error = %v, want a plan change %v", err, tt.sent == 0)
+			}
+			if sent := stub.transfers(); sent != tt.sent {
+				t.Errorf("sent %d transfers, want %d", sent, tt.sent)
+			}
+			stored, err := runStore.Get(run.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != tt.status {
+				t.Errorf("status = %s, want %s", stored.Status, tt.status)
+			}
+		})
+	}
+}
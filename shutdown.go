@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// draining is set once a shutdown signal arrives. New runs are refused and
+// the run in progress stops after its current event.
+var draining atomic.Bool
+
+func isDraining() bool {
+	return draining.Load()
+}
+
+// drainOnSignal starts draining on the first SIGINT or SIGTERM and returns a
+// channel that is closed at that moment. A second signal exits immediately.
+func drainOnSignal() <-chan struct{} {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	stopping := make(chan struct{})
+	go func() {
+		sig := <-signals
+		slog.Warn("Shutdown requested, finishing the current event", "signal", sig.String())
+		draining.Store(true)
+		close(stopping)
+
+		sig = <-signals
+		slog.Error("Second signal received, exiting immediately", "signal", sig.String())
+		os.Exit(1)
+	}()
+	return stopping
+}
+
+// waitForRuns blocks until no run is executing. Runs check isDraining between
+// events, so this returns once the current event has fully completed.
+func waitForRuns() {
+	runMu.Lock()
+	runMu.Unlock()
+}
+
+// reportInterruptedRuns is called when the server starts. Runs stopped by a
+// graceful shutdown are reported and, with RESUME_INTERRUPTED_RUNS=true,
+// resumed. A run still marked running while no process holds the run lock
+// was killed without draining, whether it ran in the server or the CLI; its
+// checkpoints say how far the event in flight got, so it is marked
+// interrupted and handled the same way.
+func reportInterruptedRuns(ctx context.Context) {
+	runs, err := runStore.List()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load run history", "error", err)
+		return
+	}
+
+	// A run another process is executing right now is not interrupted.
+	busy := runLockHeld()
+
+	for i := range runs {
+		run := &runs[i]
+		runCtx := withLogAttrs(ctx, "run_id", run.ID)
+		completed := run.completedEvents()
+		remaining := len(run.Plan.Items) - completed
+
+		switch {
+		case run.Status == "running" && !busy:
+			if _, err := claimRun(run.ID, "running", func(run *Run) { run.Status = "interrupted" }); err != nil {
+				slog.ErrorContext(runCtx, "Failed to record run", "error", err)
+				continue
+			}
+			if completed < len(run.Results) {
+				inFlight := run.Results[completed]
+				slog.WarnContext(runCtx, "Run was killed mid-event", "completed", completed, "remaining", remaining,
+					"event_record_id", inFlight.RecordID, "hcb_event_id", inFlight.HCBEventID, "step", inFlight.Step)
+				if inFlight.Step == stepTransferStarted {
+					postSlack(runCtx, fmt.Sprintf(":rotating_light: Run `%s` was killed while sending to `%s`. "+
+						"That transfer will not be resent on resume; check HCB and `cash-cannon reconcile`.",
+						run.ID, inFlight.HCBEventID))
+				}
+				if inFlight.Step == stepBalanceStarted {
+					postSlack(runCtx, fmt.Sprintf(":rotating_light: Run `%s` was killed while recording the disbursement on `%s`. "+
+						"Check its amount_owed before the next run.", run.ID, inFlight.HCBEventID))
+				}
+			}
+			fallthrough
+
+		case run.Status == "interrupted":
+			if os.Getenv("RESUME_INTERRUPTED_RUNS") == "true" {
+				// Claimed like a manual resume, so an operator resuming
+				// the run at the same moment is refused.
+				claimed, err := claimRun(run.ID, "interrupted", func(run *Run) { run.Status = "running" })
+				if err != nil {
+					slog.WarnContext(runCtx, "Not resuming interrupted run", "error", err)
+					continue
+				}
+				slog.InfoContext(runCtx, "Resuming interrupted run", "remaining", remaining)
+				go executeRun(runCtx, claimed)
+				continue
+			}
+			slog.WarnContext(runCtx, "Interrupted run awaiting resume", "completed", completed, "remaining", remaining)
+			postSlack(runCtx, fmt.Sprintf(":pause_button: Run `%s` was interrupted with %d events remaining. "+
+				"Resume it from the dashboard or with `cash-cannon runs resume %s`.", run.ID, remaining, run.ID))
+		}
+	}
+}
+
+// resumeRun continues an interrupted run from its last checkpoint.
+func resumeRun(ctx context.Context, id, operator string) (*Run, error) {
+	run, err := claimRun(id, "interrupted", func(run *Run) { run.Status = "running" })
+	if err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(withLogAttrs(ctx, "run_id", id), "Resuming interrupted run", "resumed_by", operator)
+	executeRun(ctx, run)
+	return run, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// TestKilledCLIRunIsInterrupted checks that a CLI run left running by a
+// killed process can be resumed once the server starts.
+func TestKilledCLIRunIsInterrupted(t *testing.T) {
+	newStubUpstream(t)
+	t.Setenv("RESUME_INTERRUPTED_RUNS", "")
+
+	run := newRun(Plan{Mode: "custom", Items: []PlanItem{{RecordID: "recEvent0000001", HCBEventID: "hq", Amount: 10}}}, "cli", "test")
+	run.Status = "running"
+	if err := runStore.Save(run); err != nil {
+		t.Fatal(err)
+	}
+
+	reportInterruptedRuns(context.Background())
+
+	stored, err := runStore.Get(run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != "interrupted" {
+		t.Errorf("status = %s, want interrupted", stored.Status)
+	}
+}
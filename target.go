@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// EventTarget narrows the events a custom disbursement goes to. The zero
+// value is every event in the events view. A formula and selected records
+// may be combined; both are applied within the view.
+type EventTarget struct {
+	View      string   `json:"view,omitempty"`
+	Formula   string   `json:"formula,omitempty"`
+	RecordIDs []string `json:"record_ids,omitempty"`
+}
+
+// errMissingRecords means selected records were not in the view or filter.
+var errMissingRecords = errors.New("selected records not in the view or filter")
+
+var (
+	viewIDPattern   = regexp.MustCompile(`^viw[A-Za-z0-9]{14}$`)
+	recordIDPattern = regexp.MustCompile(`^rec[A-Za-z0-9]{14}$`)
+)
+
+// parseEventTarget reads the view, formula and record_ids fields from a
+// query string or form; get is c.Query or c.PostForm. record_ids is a comma-
+// or whitespace-separated list.
+func parseEventTarget(get func(string) string) (EventTarget, error) {
+	target := EventTarget{
+		View:      strings.TrimSpace(get("view")),
+		Formula:   strings.TrimSpace(get("formula")),
+		RecordIDs: strings.FieldsFunc(get("record_ids"), func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\t' }),
+	}
+	if err := target.validate(); err != nil {
+		return EventTarget{}, err
+	}
+	return target, nil
+}
+
+// validate checks the view and record IDs are Airtable IDs.
+func (target EventTarget) validate() error {
+	if target.View != "" && !viewIDPattern.MatchString(target.View) {
+		return fmt.Errorf("view %q is not an Airtable view ID (viw...)", target.View)
+	}
+	for _, id := range target.RecordIDs {
+		if !recordIDPattern.MatchString(id) {
+			return fmt.Errorf("%q is not an Airtable record ID (rec...)", id)
+		}
+	}
+	return nil
+}
+
+func (target EventTarget) isDefault() bool {
+	return target.View == "" && target.Formula == "" && len(target.RecordIDs) == 0
+}
+
+// query returns the Airtable list parameters for the target.
+func (target EventTarget) query() url.Values {
+	query := url.Values{}
+	query.Set("view", eventsViewID)
+	if target.View != "" {
+		query.Set("view", target.View)
+	}
+
+	var filters []string
+	if target.Formula != "" {
+		filters = append(filters, target.Formula)
+	}
+	if len(target.RecordIDs) > 0 {
+		matches := make([]string, len(target.RecordIDs))
+		for i, id := range target.RecordIDs {
+			matches[i] = fmt.Sprintf("RECORD_ID()='%s'", id)
+		}
+		filters = append(filters, "OR("+strings.Join(matches, ",")+")")
+	}
+	switch len(filters) {
+	case 1:
+		query.Set("filterByFormula", filters[0])
+	case 2:
+		query.Set("filterByFormula", "AND("+strings.Join(filters, ",")+")")
+	}
+	return query
+}
+
+// checkSelected fails when a selected record was not returned, so a record
+// outside the view or filter is never silently skipped.
+func (target EventTarget) checkSelected(events []AirtableEvent) error {
+	found := make(map[string]bool)
+	for _, event := range events {
+		found[event.ID] = true
+	}
+
+	var missing []string
+	for _, id := range target.RecordIDs {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", errMissingRecords, strings.Join(missing, ", "))
+	}
+	return nil
+}
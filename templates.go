@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// HCB transfer names and the memo line added to the Airtable notes are Go
+// text/templates, configurable per disbursement type with
+//
+//	TRANSFER_NAME_TEMPLATE_<TYPE>
+//	TRANSFER_MEMO_TEMPLATE_<TYPE>
+//
+// where TYPE is AUTOGRANT, WITHDRAWAL, MISCELLANEOUS or CLAWBACK. Templates
+// see the fields of TransferText, e.g.
+//
+//	Campfire prize {{.DisbursementID}} for {{.HCBEventID}}{{with .Memo}}: {{.}}{{end}}
+var defaultNameTemplates = map[string]string{
+	"autogrant":     "Campfire signup grant ID {{.DisbursementID}}",
+	"withdrawal":    "Campfire signup withdrawal ID {{.DisbursementID}}",
+	"miscellaneous": "Campfire miscellaneous disbursement {{.DisbursementID}}{{with .Memo}} - {{.}}{{end}}",
+	"clawback":      "Campfire miscellaneous clawback {{.DisbursementID}}{{with .Memo}} - {{.}}{{end}}",
+}
+
+const defaultMemoTemplate = "{{.Memo}}"
+
+var transferTypes = []string{"autogrant", "withdrawal", "miscellaneous", "clawback"}
+
+// TransferText is the data the name and memo templates are rendered with.
+type TransferText struct {
+	Type           string
+	RunID          string
+	Operator       string
+	Memo           string
+	DisbursementID int
+	RecordID       string
+	HCBEventID     string
+	Amount         float64
+}
+
+func nameTemplate(disbursementType string) string {
+	if text := os.Getenv("TRANSFER_NAME_TEMPLATE_" + strings.ToUpper(disbursementType)); text != "" {
+		return text
+	}
+	return defaultNameTemplates[disbursementType]
+}
+
+func memoTemplate(disbursementType string) string {
+	if text := os.Getenv("TRANSFER_MEMO_TEMPLATE_" + strings.ToUpper(disbursementType)); text != "" {
+		return text
+	}
+	return defaultMemoTemplate
+}
+
+// name renders the HCB transfer name for t.Type.
+func (t TransferText) name() string {
+	name, err := renderTransferText(nameTemplate(t.Type), t)
+	if err != nil {
+		slog.Error("Failed to render transfer name, using the default", "type", t.Type, "error", err)
+		name, _ = renderTransferText(defaultNameTemplates[t.Type], t)
+	}
+	return name
+}
+
+// memo renders the line added to the Airtable notes; it is often empty.
+func (t TransferText) memo() string {
+	memo, err := renderTransferText(memoTemplate(t.Type), t)
+	if err != nil {
+		slog.Error("Failed to render transfer memo, using the default", "type", t.Type, "error", err)
+		memo, _ = renderTransferText(defaultMemoTemplate, t)
+	}
+	return memo
+}
+
+// withMemo appends the rendered memo to Airtable notes.
+func (t TransferText) withMemo(notes string) string {
+	if memo := t.memo(); memo != "" {
+		notes += ". Memo: " + memo
+	}
+	return notes
+}
+
+func renderTransferText(text string, data TransferText) (string, error) {
+	tmpl, err := template.New("transfer").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// checkTransferTemplates renders every configured template with sample data
+// so a typo fails at startup rather than mid-run.
+func checkTransferTemplates() []error {
+	sample := TransferText{
+		RunID:          "run_20060102T150405_abcdef",
+		Operator:       "operator",
+		Memo:           "memo",
+		DisbursementID: 1,
+		RecordID:       "recXXXXXXXXXXXXXX",
+		HCBEventID:     "event",
+		Amount:         1,
+	}
+
+	var errs []error
+	for _, disbursementType := range transferTypes {
+		sample.Type = disbursementType
+		suffix := strings.ToUpper(disbursementType)
+		if name, err := renderTransferText(nameTemplate(disbursementType), sample); err != nil {
+			errs = append(errs, fmt.Errorf("TRANSFER_NAME_TEMPLATE_%s: %v", suffix, err))
+		} else if name == "" {
+			errs = append(errs, fmt.Errorf("TRANSFER_NAME_TEMPLATE_%s renders an empty name", suffix))
+		}
+		if _, err := renderTransferText(memoTemplate(disbursementType), sample); err != nil {
+			errs = append(errs, fmt.Errorf("TRANSFER_MEMO_TEMPLATE_%s: %v", suffix, err))
+		}
+	}
+	return errs
+}
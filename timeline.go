@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// EventTimeline is everything sent to or taken from one HCB organization,
+// from the run history and the Airtable disbursements table, oldest first.
+// Net is the running total of the money that actually moved; failed, unknown
+// and rejected attempts are listed separately and do not count.
+type EventTimeline struct {
+	HCBEventID   string              `json:"hcb_event_id"`
+	Organization string              `json:"organization,omitempty"`
+	RecordIDs    []string            `json:"record_ids"`
+	AmountOwed   *float64            `json:"amount_owed"`
+	Entries      []TimelineEntry     `json:"entries"`
+	Failed       []DisbursementEntry `json:"failed"`
+	Totals       map[string]float64  `json:"totals"`
+	Net          float64             `json:"net"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+type TimelineEntry struct {
+	DisbursementEntry
+	Net float64 `json:"net"`
+}
+
+// eventTimeline builds the timeline for hcbEventID. The events' current
+// amount_owed, their disbursement records and the organization name are
+// looked up live; if a lookup fails the timeline is still returned with the
+// error. Only loading the run history is fatal.
+func eventTimeline(ctx context.Context, hcbEventID string) (*EventTimeline, error) {
+	entries, err := listDisbursements(HistoryFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	timeline := &EventTimeline{
+		HCBEventID: hcbEventID,
+		RecordIDs:  []string{},
+		Entries:    []TimelineEntry{},
+		Failed:     []DisbursementEntry{},
+		Totals:     make(map[string]float64),
+	}
+
+	var matched []DisbursementEntry
+	inLedger := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.HCBEventID == hcbEventID {
+			matched = append(matched, entry)
+			if entry.DisbursementRecordID != "" {
+				inLedger[entry.DisbursementRecordID] = true
+			}
+		}
+	}
+
+	events, err := getAllEvents(ctx, EventTarget{Formula: fmt.Sprintf("{hcb_event_id}='%s'", hcbEventID)})
+	if err != nil {
+		timeline.Errors = append(timeline.Errors, fmt.Sprintf("failed to fetch amount_owed: %v", err))
+	} else {
+		owed := 0.0
+		for _, event := range events {
+			if event.Fields.HCBEventID != hcbEventID {
+				continue
+			}
+			timeline.RecordIDs = append(timeline.RecordIDs, event.ID)
+			owed += event.Fields.AmountOwed
+		}
+		if len(timeline.RecordIDs) > 0 {
+			timeline.AmountOwed = &owed
+		}
+	}
+
+	if len(timeline.RecordIDs) > 0 {
+		records, err := eventDisbursementRecords(ctx, timeline.RecordIDs)
+		if err != nil {
+			timeline.Errors = append(timeline.Errors, fmt.Sprintf("failed to fetch the Airtable disbursements: %v", err))
+		}
+		for _, record := range records {
+			if !inLedger[record.ID] {
+				matched = append(matched, airtableDisbursementEntry(record, hcbEventID))
+			}
+		}
+	}
+
+	// Oldest first; a run's results keep their order
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].At.Before(matched[j].At) })
+
+	for _, entry := range matched {
+		if entry.Status != "processed" || transferState(entry.HCBTransferStatus) == transferRejected {
+			timeline.Failed = append(timeline.Failed, entry)
+			continue
+		}
+		timeline.Net += entry.Amount
+		timeline.Totals[entry.Type] += entry.Amount
+		timeline.Entries = append(timeline.Entries, TimelineEntry{DisbursementEntry: entry, Net: timeline.Net})
+	}
+
+	if org, err := resolveOrganization(ctx, hcbEventID); err != nil {
+		timeline.Errors = append(timeline.Errors, fmt.Sprintf("failed to look up the HCB organization: %v", err))
+	} else {
+		timeline.Organization = org.Name
+	}
+
+	return timeline, nil
+}
+
+// eventDisbursementRecords returns the disbursement records linked to any of
+// the event records. Airtable formulas see a linked record by its primary
+// field rather than its record ID, so the whole table is read and matched
+// here.
+func eventDisbursementRecords(ctx context.Context, eventRecordIDs []string) ([]AirtableDisbursementResponse, error) {
+	records, err := getDisbursements(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool, len(eventRecordIDs))
+	for _, id := range eventRecordIDs {
+		wanted[id] = true
+	}
+
+	var linked []AirtableDisbursementResponse
+	for _, record := range records {
+		for _, event := range record.Fields.AssociatedEvent {
+			if wanted[event] {
+				linked = append(linked, record)
+				break
+			}
+		}
+	}
+	return linked, nil
+}
+
+// airtableDisbursementEntry is the timeline entry for a disbursement record
+// that is not in the run history: one made before the history was kept, by
+// another instance, or by hand. Records still pending are unknown, since
+// nothing says whether their transfer went out.
+func airtableDisbursementEntry(record AirtableDisbursementResponse, hcbEventID string) DisbursementEntry {
+	result := RunResult{
+		PlanItem:             PlanItem{HCBEventID: hcbEventID, Amount: record.Fields.Amount},
+		DisbursementRecordID: record.ID,
+		DisbursementID:       record.Fields.DisbursementID,
+		HCBTransferID:        record.Fields.HCBTransferID,
+		HCBTransferStatus:    record.Fields.HCBTransferStatus,
+	}
+	if len(record.Fields.AssociatedEvent) > 0 {
+		result.RecordID = record.Fields.AssociatedEvent[0]
+	}
+
+	switch record.Fields.Status {
+	case "processed":
+		// Written for every successful disbursement before transfer
+		// states were tracked
+		result.Status = "processed"
+	case transferSubmitted, transferCompleted, transferRejected:
+		result.Status = "processed"
+		if result.HCBTransferStatus == "" {
+			result.HCBTransferStatus = record.Fields.Status
+		}
+	case "failed":
+		result.Status = "failed"
+	default:
+		result.Status = "unknown"
+	}
+
+	disbursementType := record.Fields.DisbursementType
+	if disbursementType == "" {
+		disbursementType = disbursementTypeFor("", record.Fields.Amount)
+	}
+	return DisbursementEntry{
+		RunResult: result,
+		Source:    "airtable",
+		Type:      disbursementType,
+		At:        record.CreatedTime,
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventTimelineMergesAirtable(t *testing.T) {
+	stub := newStubUpstream(t)
+	stub.responses = map[string]interface{}{
+		"/v0/appTest/events": map[string]interface{}{"records": []interface{}{
+			map[string]interface{}{"id": "recTimeline0001", "fields": map[string]interface{}{"hcb_event_id": "timeline-test", "amount_owed": 5.0}},
+		}},
+		"/v0/appTest/disbursements": map[string]interface{}{"records": []interface{}{
+			// Also in the run history, which wins
+			map[string]interface{}{"id": "recDisbLedger01", "createdTime": "2026-03-01T00:00:00.000Z",
+				"fields": map[string]interface{}{"associated_event": []string{"recTimeline0001"}, "amount": 99.0, "status": "completed"}},
+			map[string]interface{}{"id": "recDisbManual01", "createdTime": "2026-01-01T00:00:00.000Z",
+				"fields": map[string]interface{}{"associated_event": []string{"recTimeline0001"}, "amount": 40.0, "status": "completed", "disbursement_type": "miscellaneous"}},
+			map[string]interface{}{"id": "recDisbManual02", "createdTime": "2026-01-02T00:00:00.000Z",
+				"fields": map[string]interface{}{"associated_event": []string{"recTimeline0001"}, "amount": 15.0, "status": "rejected"}},
+			map[string]interface{}{"id": "recDisbManual03", "createdTime": "2026-01-03T00:00:00.000Z",
+				"fields": map[string]interface{}{"associated_event": []string{"recTimeline0001"}, "amount": 15.0, "status": "pending"}},
+			// Written before transfer states were tracked
+			map[string]interface{}{"id": "recDisbLegacy01", "createdTime": "2025-06-01T00:00:00.000Z",
+				"fields": map[string]interface{}{"associated_event": []string{"recTimeline0001"}, "amount": 10.0, "status": "processed", "disbursement_type": "autogrant"}},
+			map[string]interface{}{"id": "recDisbOther001", "createdTime": "2026-01-04T00:00:00.000Z",
+				"fields": map[string]interface{}{"associated_event": []string{"recOtherEvent01"}, "amount": 70.0, "status": "completed"}},
+		}},
+		"/api/v4/organizations/timeline-test": map[string]interface{}{"id": "org_test", "name": "Timeline Test"},
+	}
+
+	run := &Run{ID: "run_timeline", Mode: "autogrant", Status: "completed", StartedAt: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	run.Results = []RunResult{{
+		PlanItem:             PlanItem{RecordID: "recTimeline0001", HCBEventID: "timeline-test", Amount: 25},
+		DisbursementRecordID: "recDisbLedger01",
+		HCBTransferStatus:    "completed",
+		Status:               "processed",
+	}}
+	if err := runStore.Save(run); err != nil {
+		t.Fatal(err)
+	}
+
+	timeline, err := eventTimeline(context.Background(), "timeline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeline.Errors) > 0 {
+		t.Fatalf("errors = %q", timeline.Errors)
+	}
+
+	var entries, failed []string
+	for _, entry := range timeline.Entries {
+		entries = append(entries, entry.DisbursementRecordID)
+	}
+	for _, entry := range timeline.Failed {
+		failed = append(failed, entry.DisbursementRecordID)
+	}
+	if want := []string{"recDisbLegacy01", "recDisbManual01", "recDisbLedger01"}; !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %q, want %q", entries, want)
+	}
+	if want := []string{"recDisbManual02", "recDisbManual03"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed = %q, want %q", failed, want)
+	}
+	if timeline.Net != 75 {
+		t.Errorf("net = %v, want 75", timeline.Net)
+	}
+	if timeline.Totals["autogrant"] != 35 {
+		t.Errorf("autogrant total = %v, want 35", timeline.Totals["autogrant"])
+	}
+	if timeline.Entries[1].Source != "airtable" || timeline.Entries[1].Type != "miscellaneous" {
+		t.Errorf("Airtable entry = %+v, want source airtable and type miscellaneous", timeline.Entries[1])
+	}
+	if timeline.Organization != "Timeline Test" {
+		t.Errorf("organization = %q", timeline.Organization)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API tokens let automations call /api/v1 without the shared basic-auth
+// password. A token is shown once, when it is created; only its SHA-256 hash
+// is stored. Each scope includes the ones before it:
+//
+//	read      the GET endpoints
+//	plan      previewing plans
+//	execute   starting, approving, rejecting, resuming and retrying runs,
+//	          and redelivering webhooks
+//
+// Tokens expire (default 90 days, at most 365) and are created and revoked
+// on the dashboard's tokens page, which only basic auth can reach. Use is
+// recorded at most once a minute.
+const (
+	scopeRead    = "read"
+	scopePlan    = "plan"
+	scopeExecute = "execute"
+)
+
+var tokenScopes = []string{scopeRead, scopePlan, scopeExecute}
+
+const (
+	tokenPrefix        = "cc_"
+	defaultTokenDays   = 90
+	maxTokenDays       = 365
+	tokenUsageInterval = time.Minute
+)
+
+var (
+	errTokenInvalid = errors.New("invalid API token")
+	errTokenExpired = errors.New("API token has expired")
+	errTokenRevoked = errors.New("API token has been revoked")
+)
+
+type APIToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	Hash       string     `json:"hash,omitempty"`
+	Hint       string     `json:"hint"`
+	Status     string     `json:"status,omitempty"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy  string     `json:"revoked_by,omitempty"`
+}
+
+// TokenRequest creates a token; expires_in_days defaults to 90.
+type TokenRequest struct {
+	Name          string `json:"name"`
+	Scope         string `json:"scope"`
+	ExpiresInDays int    `json:"expires_in_days,omitempty"`
+}
+
+// NewToken is returned once, when a token is created.
+type NewToken struct {
+	Token  APIToken `json:"token"`
+	Secret string   `json:"secret"`
+}
+
+type TokenList struct {
+	Tokens []APIToken `json:"tokens"`
+}
+
+// public returns the token as the API shows it: without its hash and with
+// its current status.
+func (token APIToken) public(now time.Time) APIToken {
+	token.Hash = ""
+	switch {
+	case token.RevokedAt != nil:
+		token.Status = "revoked"
+	case !now.Before(token.ExpiresAt):
+		token.Status = "expired"
+	default:
+		token.Status = "active"
+	}
+	return token
+}
+
+// scopeAllows reports whether a token with scope may call an endpoint that
+// needs required.
+func scopeAllows(scope, required string) bool {
+	have, need := -1, -1
+	for i, s := range tokenScopes {
+		if s == scope {
+			have = i
+		}
+		if s == required {
+			need = i
+		}
+	}
+	return have >= 0 && need >= 0 && have >= need
+}
+
+func validScope(scope string) bool {
+	for _, s := range tokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenStore keeps the API tokens next to the run history. Writes hold a
+// file lock, like the other stores.
+type TokenStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+var tokenStore = &TokenStore{path: filepath.Join(dataDir(), "api_tokens.json")}
+
+// List returns every token, newest first.
+func (s *TokenStore) List() ([]APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tokens []APIToken
+	if err := readJSONFile(s.path, &tokens); err != nil {
+		return nil, err
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+// Update applies fn to the token with the ID and saves it.
+func (s *TokenStore) Update(id string, fn func(*APIToken) error) (*APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var tokens []APIToken
+	if err := readJSONFile(s.path, &tokens); err != nil {
+		return nil, err
+	}
+	for i := range tokens {
+		if tokens[i].ID != id {
+			continue
+		}
+		if err := fn(&tokens[i]); err != nil {
+			return nil, err
+		}
+		if err := writeJSONFile(s.path, tokens); err != nil {
+			return nil, err
+		}
+		return &tokens[i], nil
+	}
+	return nil, fmt.Errorf("token %s %w", id, errNotFound)
+}
+
+func (s *TokenStore) Add(token *APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var tokens []APIToken
+	if err := readJSONFile(s.path, &tokens); err != nil {
+		return err
+	}
+	return writeJSONFile(s.path, append(tokens, *token))
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func createToken(ctx context.Context, req TokenRequest, operator string) (*NewToken, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 100 {
+		return nil, fmt.Errorf("a token needs a name of at most 100 characters")
+	}
+	if !validScope(req.Scope) {
+		return nil, fmt.Errorf("scope must be one of %s", strings.Join(tokenScopes, ", "))
+	}
+	days := req.ExpiresInDays
+	if days == 0 {
+		days = defaultTokenDays
+	}
+	if days < 1 || days > maxTokenDays {
+		return nil, fmt.Errorf("expires_in_days must be between 1 and %d", maxTokenDays)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	secret := tokenPrefix + hex.EncodeToString(b)
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	token := APIToken{
+		ID:        "tok_" + hex.EncodeToString(id),
+		Name:      name,
+		Scope:     req.Scope,
+		Hash:      hashToken(secret),
+		Hint:      secret[:len(tokenPrefix)+6] + "…",
+		CreatedBy: operator,
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, days),
+	}
+	if err := tokenStore.Add(&token); err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "API token created", "token_id", token.ID, "token_name", token.Name, "scope", token.Scope)
+	return &NewToken{Token: token.public(now), Secret: secret}, nil
+}
+
+func revokeToken(ctx context.Context, id, operator string) (*APIToken, error) {
+	now := time.Now()
+	token, err := tokenStore.Update(id, func(token *APIToken) error {
+		if token.RevokedAt != nil {
+			return fmt.Errorf("token %s: %w", id, errTokenRevoked)
+		}
+		token.RevokedAt = &now
+		token.RevokedBy = operator
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "API token revoked", "token_id", token.ID, "token_name", token.Name)
+	public := token.public(now)
+	return &public, nil
+}
+
+// authenticateToken returns the token for secret if it is active, and
+// records its use.
+func authenticateToken(secret, ip string) (*APIToken, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, errTokenInvalid
+	}
+	tokens, err := tokenStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := hashToken(secret)
+	var token *APIToken
+	for i := range tokens {
+		if subtle.ConstantTimeCompare([]byte(tokens[i].Hash), []byte(hash)) == 1 {
+			token = &tokens[i]
+		}
+	}
+	now := time.Now()
+	switch {
+	case token == nil:
+		return nil, errTokenInvalid
+	case token.RevokedAt != nil:
+		return nil, errTokenRevoked
+	case !now.Before(token.ExpiresAt):
+		return nil, errTokenExpired
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= tokenUsageInterval || token.LastUsedIP != ip {
+		_, err := tokenStore.Update(token.ID, func(stored *APIToken) error {
+			stored.LastUsedAt = &now
+			stored.LastUsedIP = ip
+			return nil
+		})
+		if err != nil {
+			slog.Error("Failed to record API token use", "token_id", token.ID, "error", err)
+		}
+	}
+	return token, nil
+}
+
+// apiAuth authenticates an /api/v1 request with a bearer token that has the
+// scope, or with the dashboard's basic-auth credentials, which may call
+// every endpoint. Requests made with a token are attributed to
+// "token:<name>".
+func apiAuth(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if secret, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			token, err := authenticateToken(strings.TrimSpace(secret), c.ClientIP())
+			if err != nil {
+				if !errors.Is(err, errTokenInvalid) && !errors.Is(err, errTokenExpired) && !errors.Is(err, errTokenRevoked) {
+					apiFail(c, 500, codeInternal, fmt.Sprintf("Failed to load API tokens: %v", err), nil)
+					return
+				}
+				apiFail(c, 401, codeUnauthorized, err.Error(), nil)
+				return
+			}
+			if !scopeAllows(token.Scope, scope) {
+				apiFail(c, 403, codeForbidden, fmt.Sprintf("Token %q has the %s scope; this endpoint needs %s", token.Name, token.Scope, scope), nil)
+				return
+			}
+			c.Set(gin.AuthUserKey, "token:"+token.Name)
+			c.Request = c.Request.WithContext(withLogAttrs(c.Request.Context(), "token_id", token.ID))
+			c.Next()
+			return
+		}
+
+		user, password, ok := c.Request.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(user), []byte(os.Getenv("BASIC_AUTH_USERNAME"))) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(os.Getenv("BASIC_AUTH_PASSWORD"))) == 1 {
+			c.Set(gin.AuthUserKey, user)
+			c.Next()
+			return
+		}
+
+		c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+		apiFail(c, 401, codeUnauthorized, "Authenticate with an API token (Authorization: Bearer cc_…) or basic auth", nil)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// A 2xx from HCB only means the transfer was accepted. Disbursements are
+// recorded as submitted and pollTransfers follows each transfer until HCB
+// settles it:
+//
+//	submitted   HCB accepted the transfer and has not settled it yet
+//	completed   the money arrived
+//	rejected    HCB rejected or cancelled the transfer; nothing moved
+//
+// Every transition is appended to the disbursement notes. The poll runs on
+// TRANSFER_POLL_SCHEDULE (default "@every 5m", "off" disables it) and on
+// demand with `cash-cannon transfers poll`.
+const (
+	transferSubmitted = "submitted"
+	transferCompleted = "completed"
+	transferRejected  = "rejected"
+)
+
+const defaultTransferPollSchedule = "@every 5m"
+
+// transferState maps an HCB transfer status onto a disbursement status.
+// Anything HCB has not finished with is still submitted.
+func transferState(hcbStatus string) string {
+	switch strings.ToLower(hcbStatus) {
+	case "completed", "deposited", "fulfilled", "settled":
+		return transferCompleted
+	case "rejected", "canceled", "cancelled", "failed", "declined":
+		return transferRejected
+	}
+	return transferSubmitted
+}
+
+// transferPollSchedule returns the cron spec for the poll, or "" when it is
+// turned off.
+func transferPollSchedule() string {
+	spec := os.Getenv("TRANSFER_POLL_SCHEDULE")
+	switch spec {
+	case "":
+		return defaultTransferPollSchedule
+	case "off":
+		return ""
+	}
+	return spec
+}
+
+// TransferPollResult summarises one pass over the submitted disbursements.
+type TransferPollResult struct {
+	Checked     int                  `json:"checked"`
+	Transitions []TransferTransition `json:"transitions"`
+	Errors      []string             `json:"errors,omitempty"`
+}
+
+type TransferTransition struct {
+	RecordID       string `json:"record_id"`
+	DisbursementID int    `json:"disbursement_id"`
+	HCBTransferID  string `json:"hcb_transfer_id"`
+	HCBStatus      string `json:"hcb_transfer_status"`
+	From           string `json:"from"`
+	To             string `json:"to"`
+}
+
+func scheduledTransferPoll() {
+	ctx := withLogAttrs(context.Background(), "user", "scheduler")
+	if _, err := pollTransfers(ctx); err != nil {
+		slog.ErrorContext(ctx, "Transfer poll failed", "error", err)
+	}
+}
+
+// pollTransfers asks HCB for the status of every submitted disbursement and
+// records the ones that changed. A pass is skipped while a run is executing
+// so it never races the run's own updates to the ledger.
+func pollTransfers(ctx context.Context) (*TransferPollResult, error) {
+	if !runMu.TryLock() {
+		slog.DebugContext(ctx, "Skipping transfer poll while a run is executing")
+		return &TransferPollResult{}, nil
+	}
+	defer runMu.Unlock()
+	unlock, ok, err := tryLockFile(runLockPath())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		slog.DebugContext(ctx, "Skipping transfer poll while another process is executing a run")
+		return &TransferPollResult{}, nil
+	}
+	defer unlock()
+
+	submitted, err := getDisbursementsByStatus(ctx, transferSubmitted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch submitted disbursements: %v", err)
+	}
+
+	result := &TransferPollResult{}
+	for _, d := range submitted {
+		if d.Fields.HCBTransferID == "" {
+			slog.WarnContext(ctx, "Submitted disbursement has no HCB transfer ID; check it on HCB",
+				"disbursement_record_id", d.ID, "disbursement_id", d.Fields.DisbursementID)
+			continue
+		}
+		result.Checked++
+
+		transfer, err := getHCBTransfer(ctx, d.Fields.HCBTransferID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to fetch HCB transfer", "hcb_transfer_id", d.Fields.HCBTransferID, "error", err)
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", d.Fields.HCBTransferID, err))
+			continue
+		}
+		if transfer.Status == d.Fields.HCBTransferStatus {
+			continue
+		}
+
+		transition := TransferTransition{
+			RecordID:       d.ID,
+			DisbursementID: d.Fields.DisbursementID,
+			HCBTransferID:  d.Fields.HCBTransferID,
+			HCBStatus:      transfer.Status,
+			From:           d.Fields.Status,
+			To:             transferState(transfer.Status),
+		}
+		if err := recordTransferTransition(ctx, d, transition); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", d.Fields.HCBTransferID, err))
+			continue
+		}
+		result.Transitions = append(result.Transitions, transition)
+	}
+
+	slog.InfoContext(ctx, "Transfer poll finished", "checked", result.Checked,
+		"transitions", len(result.Transitions), "errors", len(result.Errors))
+	return result, nil
+}
+
+// recordTransferTransition writes the new status to Airtable and the run
+// history, and reports rejected transfers.
+func recordTransferTransition(ctx context.Context, d AirtableDisbursementResponse, transition TransferTransition) error {
+	ctx = withLogAttrs(ctx, "disbursement_record_id", d.ID, "hcb_transfer_id", transition.HCBTransferID)
+
+	notes := d.Fields.Notes
+	if notes != "" {
+		notes += "\n"
+	}
+	notes += fmt.Sprintf("%s: HCB transfer %s is %s", time.Now().UTC().Format(time.RFC3339),
+		transition.HCBTransferID, transition.HCBStatus)
+	if transition.To != transition.From {
+		notes += fmt.Sprintf(", disbursement %s", transition.To)
+	}
+
+	err := updateDisbursement(ctx, d.ID, map[string]interface{}{
+		"status":              transition.To,
+		"notes":               notes,
+		"hcb_transfer_status": transition.HCBStatus,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record HCB transfer status", "error", err)
+		return err
+	}
+	slog.InfoContext(ctx, "HCB transfer status changed", "hcb_transfer_status", transition.HCBStatus,
+		"from", transition.From, "to", transition.To)
+
+	result, err := updateRunResult(d.ID, func(result *RunResult) { result.HCBTransferStatus = transition.HCBStatus })
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record HCB transfer status in the run history", "error", err)
+	}
+
+	if transition.To == transferRejected {
+		postSlack(ctx, fmt.Sprintf(":x: HCB rejected transfer `%s` for disbursement %d ($%.2f to `%s`)",
+			transition.HCBTransferID, d.Fields.DisbursementID, d.Fields.Amount, strings.Join(d.Fields.AssociatedEvent, ",")))
+		if result != nil {
+			reverseRejectedBalance(ctx, d, *result)
+		}
+	}
+	return nil
+}
+
+// reverseRejectedBalance undoes the balance write-back of a disbursement HCB
+// rejected after the run recorded it on the event, so the next autogrant
+// pays the event again. Anything that cannot be reversed automatically is
+// posted to Slack: left alone, the event would silently never be paid.
+func reverseRejectedBalance(ctx context.Context, d AirtableDisbursementResponse, result RunResult) {
+	if result.Step != stepBalanceUpdated || result.BalanceReversed {
+		return
+	}
+	ctx = withLogAttrs(ctx, "event_record_id", result.RecordID, "hcb_event_id", result.HCBEventID)
+
+	switch result.BalanceWriteback {
+	case writebackIncrement:
+	case writebackVerify:
+		slog.WarnContext(ctx, "Rejected disbursement was verified against amount_owed; check the event is owed it again")
+		postSlack(ctx, fmt.Sprintf(":warning: Disbursement %d was already counted in `amount_owed` for `%s`. "+
+			"Check that `amount_owed` no longer counts it, or the event will not be paid $%.2f again.",
+			d.Fields.DisbursementID, result.HCBEventID, result.Amount))
+		return
+	default:
+		postSlack(ctx, fmt.Sprintf(":rotating_light: Disbursement %d was recorded on the balance of `%s` before HCB rejected it. "+
+			"Correct the event's balance by $%.2f by hand.", d.Fields.DisbursementID, result.HCBEventID, result.Amount))
+		return
+	}
+
+	field := amountDisbursedField()
+	if err := addAmountDisbursed(ctx, result.RecordID, -result.Amount); err != nil {
+		slog.ErrorContext(ctx, "Failed to reverse the rejected disbursement on the event", "field", field, "error", err)
+		postSlack(ctx, fmt.Sprintf(":rotating_light: Could not subtract $%.2f from `%s` on `%s` after HCB rejected disbursement %d: %v. "+
+			"Until it is corrected by hand the event will not be paid again.", result.Amount, field, result.HCBEventID, d.Fields.DisbursementID, err))
+		return
+	}
+	if _, err := updateRunResult(d.ID, func(result *RunResult) { result.BalanceReversed = true }); err != nil {
+		slog.ErrorContext(ctx, "Failed to record the reversal in the run history", "error", err)
+	}
+	slog.InfoContext(ctx, "Reversed the rejected disbursement on the event", "field", field, "amount", result.Amount)
+	postSlack(ctx, fmt.Sprintf(":leftwards_arrow_with_hook: Subtracted $%.2f from `%s` on `%s`, so the next autogrant pays it again.",
+		result.Amount, field, result.HCBEventID))
+}
+
+// updateRunResult applies fn to the run result that created the
+// disbursement and returns the updated result, or nil if the disbursement is
+// not in the history.
+func updateRunResult(disbursementRecordID string, fn func(*RunResult)) (*RunResult, error) {
+	runs, err := runStore.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range runs {
+		for j := range runs[i].Results {
+			if runs[i].Results[j].DisbursementRecordID == disbursementRecordID {
+				run, err := runStore.Update(runs[i].ID, func(run *Run) error {
+					fn(&run.Results[j])
+					return nil
+				})
+				if err != nil {
+					return nil, err
+				}
+				return &run.Results[j], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func getHCBTransfer(ctx context.Context, id string) (*HCBTransferResponse, error) {
+	body, err := getHCBTransferBody(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var transfer HCBTransferResponse
+	if err := json.Unmarshal(body, &transfer); err != nil {
+		return nil, err
+	}
+	if transfer.Status == "" {
+		return nil, fmt.Errorf("HCB returned no status for transfer %s", id)
+	}
+	return &transfer, nil
+}
+
+// getHCBTransferBody returns HCB's response for a transfer as it was sent.
+func getHCBTransferBody(ctx context.Context, id string) ([]byte, error) {
+	u := "https://hcb.hackclub.com/api/v4/transfers/" + url.PathEscape(id)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("HCB_API_TOKEN"))
+
+	resp, err := hcbClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("HCB API error (status %d): %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRejectedTransferReversesIncrement(t *testing.T) {
+	tests := []struct {
+		name      string
+		step      string
+		writeback string
+		reversed  bool
+		requests  []string
+	}{
+		{"increment", stepBalanceUpdated, writebackIncrement, true, []string{reqUpdateRecord, reqReadEvent, reqUpdateEvent}},
+		{"verify", stepBalanceUpdated, writebackVerify, false, []string{reqUpdateRecord}},
+		{"no write-back", stepStatusUpdated, "", false, []string{reqUpdateRecord}},
+		{"write-back interrupted", stepBalanceStarted, writebackIncrement, false, []string{reqUpdateRecord}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newStubUpstream(t)
+			run := &Run{ID: "run_rejected", Mode: "autogrant", Status: "completed"}
+			run.Results = []RunResult{{
+				PlanItem:             PlanItem{RecordID: "recEvent0000001", HCBEventID: "hq", Amount: 25},
+				DisbursementRecordID: "recDisb000000001",
+				HCBTransferID:        "xfr_test",
+				Step:                 tt.step,
+				Status:               "processed",
+				BalanceWriteback:     tt.writeback,
+			}}
+			if err := runStore.Save(run); err != nil {
+				t.Fatal(err)
+			}
+
+			var d AirtableDisbursementResponse
+			d.ID = "recDisb000000001"
+			transition := TransferTransition{RecordID: d.ID, HCBTransferID: "xfr_test", HCBStatus: "rejected",
+				From: transferSubmitted, To: transferRejected}
+			if err := recordTransferTransition(context.Background(), d, transition); err != nil {
+				t.Fatal(err)
+			}
+			if got := stub.sent(); !reflect.DeepEqual(got, tt.requests) {
+				t.Errorf("requests = %q, want %q", got, tt.requests)
+			}
+
+			stored, err := runStore.Get(run.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stored.Results[0].BalanceReversed; got != tt.reversed {
+				t.Errorf("balance_reversed = %v, want %v", got, tt.reversed)
+			}
+
+			// Seeing the rejection again must not reverse it twice.
+			if err := recordTransferTransition(context.Background(), d, transition); err != nil {
+				t.Fatal(err)
+			}
+			if got := stub.sent()[len(tt.requests):]; !reflect.DeepEqual(got, []string{reqUpdateRecord}) {
+				t.Errorf("requests after a second rejection = %q, want only the status update", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Per-event amounts are uploaded as a CSV file with a header row, or as a
+// JSON list of objects, using the columns:
+//
+//	hcb_event_id or record_id   the event to pay; at least one is required
+//	amount                      dollars, in whole cents; negative claws back
+//	memo                        optional, written to the disbursement notes
+//
+// Every row is checked against the events view before anything is shown,
+// and the plan is sent through the miscellaneous disbursement path.
+type UploadRow struct {
+	Line       int     `json:"-"`
+	HCBEventID string  `json:"hcb_event_id,omitempty"`
+	RecordID   string  `json:"record_id,omitempty"`
+	Amount     float64 `json:"amount"`
+	Memo       string  `json:"memo,omitempty"`
+}
+
+// maxUploadSize bounds the uploaded file; a few thousand rows fit easily.
+const maxUploadSize = 1 << 20
+
+// parseUpload reads the rows of a CSV or JSON upload. JSON is recognised by
+// the .json extension or a leading '['.
+func parseUpload(name string, data []byte) ([]UploadRow, error) {
+	trimmed := bytes.TrimSpace(data)
+	if strings.EqualFold(filepath.Ext(name), ".json") || bytes.HasPrefix(trimmed, []byte("[")) {
+		var rows []UploadRow
+		if err := json.Unmarshal(trimmed, &rows); err != nil {
+			return nil, fmt.Errorf("invalid JSON upload: %v", err)
+		}
+		for i := range rows {
+			rows[i].Line = i + 1
+		}
+		return rows, nil
+	}
+
+	reader := csv.NewReader(bytes.NewReader(trimmed))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the upload is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV upload: %v", err)
+	}
+
+	columns := make(map[string]int)
+	for i, column := range header {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))] = i
+	}
+	_, hasEvent := columns["hcb_event_id"]
+	_, hasRecord := columns["record_id"]
+	if _, ok := columns["amount"]; !ok || (!hasEvent && !hasRecord) {
+		return nil, errors.New("the CSV header needs an amount column and an hcb_event_id or record_id column")
+	}
+	field := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var rows []UploadRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV upload: %v", err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		row := UploadRow{
+			Line:       line,
+			HCBEventID: field(record, "hcb_event_id"),
+			RecordID:   field(record, "record_id"),
+			Memo:       field(record, "memo"),
+		}
+		amount := strings.TrimPrefix(field(record, "amount"), "$")
+		if row.Amount, err = parseAmount(amount); err != nil {
+			return nil, fmt.Errorf("line %d: amount %q is not a number", line, amount)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// buildUploadPlan matches every row to an event in the view and returns the
+// plan, or every problem found so the whole file can be fixed in one go.
+func buildUploadPlan(ctx context.Context, events []AirtableEvent, rows []UploadRow, name string) (Plan, []string) {
+	plan := Plan{Mode: "custom", Upload: name, TotalEvents: len(events)}
+	if len(rows) == 0 {
+		return plan, []string{"the upload has no rows"}
+	}
+
+	byRecord := make(map[string]AirtableEvent)
+	byHCBEvent := make(map[string]AirtableEvent)
+	for _, event := range events {
+		byRecord[event.ID] = event
+		byHCBEvent[event.Fields.HCBEventID] = event
+	}
+
+	var problems []string
+	seen := make(map[string]int)
+	for _, row := range rows {
+		var event AirtableEvent
+		var ok bool
+		switch {
+		case row.RecordID != "":
+			event, ok = byRecord[row.RecordID]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("line %d: no event with record_id %s in the events view", row.Line, row.RecordID))
+				continue
+			}
+			if row.HCBEventID != "" && row.HCBEventID != event.Fields.HCBEventID {
+				problems = append(problems, fmt.Sprintf("line %d: record %s has hcb_event_id %s, not %s",
+					row.Line, row.RecordID, event.Fields.HCBEventID, row.HCBEventID))
+				continue
+			}
+		case row.HCBEventID != "":
+			event, ok = byHCBEvent[row.HCBEventID]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("line %d: no event with hcb_event_id %s in the events view", row.Line, row.HCBEventID))
+				continue
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("line %d: hcb_event_id or record_id is required", row.Line))
+			continue
+		}
+
+		if previous, ok := seen[event.ID]; ok {
+			problems = append(problems, fmt.Sprintf("line %d: event %s is already on line %d", row.Line, event.Fields.HCBEventID, previous))
+			continue
+		}
+		seen[event.ID] = row.Line
+
+		if !finite(row.Amount) {
+			problems = append(problems, fmt.Sprintf("line %d: amount must be a finite number", row.Line))
+			continue
+		}
+		if row.Amount == 0 {
+			problems = append(problems, fmt.Sprintf("line %d: amount must not be zero", row.Line))
+			continue
+		}
+		if math.Abs(row.Amount*100-math.Round(row.Amount*100)) > 1e-6 {
+			problems = append(problems, fmt.Sprintf("line %d: amount %v is not a whole number of cents", row.Line, row.Amount))
+			continue
+		}
+
+		plan.Items = append(plan.Items, PlanItem{
+			RecordID:   event.ID,
+			HCBEventID: event.Fields.HCBEventID,
+			Amount:     row.Amount,
+			Direction:  directionFor(row.Amount),
+			Memo:       row.Memo,
+		})
+		plan.TotalAmount += row.Amount
+	}
+	plan.EventCount = len(plan.Items)
+	plan.validate(ctx, events)
+	return plan, problems
+}
+
+// parseAmount parses a dollar amount. strconv.ParseFloat also accepts NaN
+// and Inf, which compare false against every limit and would slip through
+// every check, so they are rejected.
+func parseAmount(s string) (float64, error) {
+	amount, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if !finite(amount) {
+		return 0, fmt.Errorf("%q is not a finite number", s)
+	}
+	return amount, nil
+}
+
+func finite(amount float64) bool {
+	return !math.IsNaN(amount) && !math.IsInf(amount, 0)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"12.50", 12.5, true},
+		{"-3", -3, true},
+		{"0", 0, true},
+		{"NaN", 0, false},
+		{"nan", 0, false},
+		{"Inf", 0, false},
+		{"-Infinity", 0, false},
+		{"1e400", 0, false},
+		{"12abc", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseAmount(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseAmount(%q) = %v, %v; want %v, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestUploadRejectsNonFiniteAmounts(t *testing.T) {
+	for _, amount := range []string{"NaN", "Inf", "-inf"} {
+		csv := "hcb_event_id,amount\nhq," + amount + "\n"
+		if _, err := parseUpload("rows.csv", []byte(csv)); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("CSV amount %s: error = %v, want a line 2 error", amount, err)
+		}
+	}
+
+	// JSON cannot encode NaN, but rows also arrive from the API already
+	// decoded, so the plan checks them again.
+	var event AirtableEvent
+	event.ID = "recEvent0000001"
+	event.Fields.HCBEventID = "hq"
+	for _, row := range []UploadRow{{Line: 1, HCBEventID: "hq", Amount: math.NaN()}, {Line: 1, HCBEventID: "hq", Amount: math.Inf(1)}} {
+		plan, problems := buildUploadPlan(context.Background(), []AirtableEvent{event}, []UploadRow{row}, "rows.json")
+		if len(problems) != 1 || len(plan.Items) != 0 {
+			t.Errorf("amount %v: problems = %q, items = %d; want one problem and no items", row.Amount, problems, len(plan.Items))
+		}
+	}
+}
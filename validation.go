@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Every plan is checked against the event data before it is shown. Each
+// event in the plan is valid, a warning (shown in the preview, still sent) or
+// blocked (left out of the run and recorded as an exclusion by
+// "validation"). An event is blocked when its hcb_event_id is empty, contains
+// whitespace or other characters HCB never uses, is shared with another
+// record, names Campfire itself, or is not an active HCB organization, or
+// when the amount is above EVENT_BLOCK_AMOUNT (default 10000). Amounts above
+// EVENT_WARN_AMOUNT (default 1000), amounts in fractions of a cent and
+// organizations HCB could not be asked about are warnings.
+const (
+	checkWarning = "warning"
+	checkBlocked = "blocked"
+)
+
+const (
+	defaultEventWarnAmount  = 1000
+	defaultEventBlockAmount = 10000
+)
+
+// excludedByValidation marks the exclusions made for blocked events.
+const excludedByValidation = "validation"
+
+var hcbEventIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// EventCheck is the validation result of one event that is not valid.
+type EventCheck struct {
+	RecordID   string   `json:"record_id"`
+	HCBEventID string   `json:"hcb_event_id"`
+	Level      string   `json:"level"`
+	Reasons    []string `json:"reasons"`
+}
+
+func eventAmountLimit(name string, fallback float64) float64 {
+	if limit, err := parseAmount(os.Getenv(name)); err == nil {
+		return limit
+	}
+	return fallback
+}
+
+// validate checks the plan's events against all the events fetched for it
+// and against HCB, records every warning and blocked event in Checks, and
+// excludes the blocked ones. The organizations' display names are kept in
+// Organizations.
+func (plan *Plan) validate(ctx context.Context, events []AirtableEvent) {
+	recordsByHCBEvent := make(map[string][]string)
+	for _, event := range events {
+		if event.Fields.HCBEventID != "" {
+			recordsByHCBEvent[event.Fields.HCBEventID] = append(recordsByHCBEvent[event.Fields.HCBEventID], event.ID)
+		}
+	}
+	warnAmount := eventAmountLimit("EVENT_WARN_AMOUNT", defaultEventWarnAmount)
+	blockAmount := eventAmountLimit("EVENT_BLOCK_AMOUNT", defaultEventBlockAmount)
+
+	var slugs []string
+	for _, item := range plan.Items {
+		if hcbEventIDPattern.MatchString(item.HCBEventID) && !strings.EqualFold(item.HCBEventID, "campfire") {
+			slugs = append(slugs, item.HCBEventID)
+		}
+	}
+	orgs := resolveOrganizations(ctx, slugs)
+
+	plan.Checks = nil
+	plan.Organizations = make(map[string]string)
+	blocked := make(map[string]string)
+	for _, item := range plan.Items {
+		var blocks, warnings []string
+		id := item.HCBEventID
+
+		switch {
+		case id == "":
+			blocks = append(blocks, "hcb_event_id is empty")
+		case strings.TrimSpace(id) != id || strings.ContainsAny(id, " \t\r\n"):
+			blocks = append(blocks, fmt.Sprintf("hcb_event_id %q contains whitespace", id))
+		case !hcbEventIDPattern.MatchString(id):
+			blocks = append(blocks, fmt.Sprintf("hcb_event_id %q is not a valid HCB organization", id))
+		case strings.EqualFold(id, "campfire"):
+			blocks = append(blocks, "hcb_event_id is Campfire itself")
+		}
+		if lookup, ok := orgs[id]; ok {
+			switch {
+			case errors.Is(lookup.err, errOrgNotFound):
+				blocks = append(blocks, fmt.Sprintf("no HCB organization %s", id))
+			case lookup.err != nil:
+				warnings = append(warnings, fmt.Sprintf("could not check the HCB organization: %v", lookup.err))
+			case lookup.org.Archived:
+				blocks = append(blocks, fmt.Sprintf("HCB organization %s is archived", id))
+			}
+			if lookup.org != nil {
+				plan.Organizations[id] = lookup.org.Name
+			}
+		}
+		if records := recordsByHCBEvent[id]; len(records) > 1 {
+			var others []string
+			for _, record := range records {
+				if record != item.RecordID {
+					others = append(others, record)
+				}
+			}
+			blocks = append(blocks, fmt.Sprintf("hcb_event_id %s is also on %s", id, strings.Join(others, ", ")))
+		}
+
+		amount := math.Abs(item.Amount)
+		switch {
+		case amount > blockAmount:
+			blocks = append(blocks, fmt.Sprintf("$%.2f is above the $%.2f limit", amount, blockAmount))
+		case amount > warnAmount:
+			warnings = append(warnings, fmt.Sprintf("$%.2f is unusually large (over $%.2f)", amount, warnAmount))
+		}
+		if math.Abs(item.Amount*100-math.Round(item.Amount*100)) > 1e-6 {
+			warnings = append(warnings, fmt.Sprintf("%v is rounded to whole cents", item.Amount))
+		}
+
+		check := EventCheck{RecordID: item.RecordID, HCBEventID: id}
+		switch {
+		case len(blocks) > 0:
+			check.Level = checkBlocked
+			check.Reasons = append(blocks, warnings...)
+			blocked[item.RecordID] = "blocked: " + strings.Join(blocks, "; ")
+		case len(warnings) > 0:
+			check.Level = checkWarning
+			check.Reasons = warnings
+		default:
+			continue
+		}
+		plan.Checks = append(plan.Checks, check)
+	}
+
+	if len(blocked) > 0 {
+		plan.excludeEvents(blocked, excludedByValidation)
+	}
+}
+
+// warnings returns the reasons recorded for an event that is still in the
+// plan, if any.
+func (plan Plan) warnings(recordID string) []string {
+	for _, check := range plan.Checks {
+		if check.RecordID == recordID && check.Level == checkWarning {
+			return check.Reasons
+		}
+	}
+	return nil
+}
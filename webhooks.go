@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outbound webhooks are configured with:
+//
+//	WEBHOOK_URLS     comma-separated endpoints that receive every event
+//	WEBHOOK_SECRET   key for the HMAC-SHA256 signature
+//	WEBHOOK_EVENTS   optional comma-separated subset of the events below
+//
+// Each request carries X-Cash-Cannon-Event, X-Cash-Cannon-Delivery,
+// X-Cash-Cannon-Timestamp and X-Cash-Cannon-Signature. The signature is
+// "sha256=" followed by the hex HMAC of "<timestamp>.<body>".
+const (
+	webhookDisbursementCreated   = "disbursement.created"
+	webhookDisbursementProcessed = "disbursement.processed"
+	webhookDisbursementFailed    = "disbursement.failed"
+	webhookRunCompleted          = "run.completed"
+)
+
+const (
+	webhookMaxAttempts = 5
+	webhookMaxLogSize  = 1000
+)
+
+// webhookBackoff is the wait before each retry; attempt n waits 2^(n-1) times
+// this long.
+var webhookBackoff = 2 * time.Second
+
+type WebhookDelivery struct {
+	ID        string           `json:"id"`
+	Event     string           `json:"event"`
+	URL       string           `json:"url"`
+	Payload   json.RawMessage  `json:"payload"`
+	Status    string           `json:"status"`
+	CreatedAt time.Time        `json:"created_at"`
+	Attempts  []WebhookAttempt `json:"attempts"`
+}
+
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+type WebhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type DisbursementWebhookData struct {
+	RunID string `json:"run_id"`
+	Mode  string `json:"mode"`
+	RunResult
+}
+
+type RunWebhookData struct {
+	RunID           string  `json:"run_id"`
+	Mode            string  `json:"mode"`
+	Source          string  `json:"source"`
+	Operator        string  `json:"operator,omitempty"`
+	Created         int     `json:"created"`
+	Processed       int     `json:"processed"`
+	Failed          int     `json:"failed"`
+	ProcessedAmount float64 `json:"processed_amount"`
+	FailedAmount    float64 `json:"failed_amount"`
+}
+
+// DeliveryStore is the webhook delivery log, kept next to the run history.
+// Save holds a file lock so the CLI and the server never lose each other's
+// writes.
+type DeliveryStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+var deliveryStore = &DeliveryStore{path: filepath.Join(dataDir(), "webhook_deliveries.json")}
+
+// webhookWG tracks in-flight deliveries so the CLI can wait for them before
+// exiting.
+var webhookWG sync.WaitGroup
+
+// List returns the logged deliveries, newest first.
+func (s *DeliveryStore) List() ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deliveries []WebhookDelivery
+	if err := readJSONFile(s.path, &deliveries); err != nil {
+		return nil, err
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt) })
+	return deliveries, nil
+}
+
+func (s *DeliveryStore) Get(id string) (*WebhookDelivery, error) {
+	deliveries, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range deliveries {
+		if deliveries[i].ID == id {
+			return &deliveries[i], nil
+		}
+	}
+	return nil, fmt.Errorf("delivery %s %w", id, errNotFound)
+}
+
+// Save upserts the delivery and trims the log to the newest entries.
+func (s *DeliveryStore) Save(delivery *WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var deliveries []WebhookDelivery
+	if err := readJSONFile(s.path, &deliveries); err != nil {
+		return err
+	}
+	replaced := false
+	for i := range deliveries {
+		if deliveries[i].ID == delivery.ID {
+			deliveries[i] = *delivery
+			replaced = true
+		}
+	}
+	if !replaced {
+		deliveries = append(deliveries, *delivery)
+	}
+	if len(deliveries) > webhookMaxLogSize {
+		deliveries = deliveries[len(deliveries)-webhookMaxLogSize:]
+	}
+	return writeJSONFile(s.path, deliveries)
+}
+
+func webhookURLs() []string {
+	var urls []string
+	for _, u := range strings.Split(os.Getenv("WEBHOOK_URLS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+func webhookEventEnabled(event string) bool {
+	filter := os.Getenv("WEBHOOK_EVENTS")
+	if filter == "" {
+		return true
+	}
+	for _, e := range strings.Split(filter, ",") {
+		if strings.TrimSpace(e) == event {
+			return true
+		}
+	}
+	return false
+}
+
+func fireDisbursementWebhook(ctx context.Context, event string, run *Run, result RunResult) {
+	fireWebhook(ctx, event, DisbursementWebhookData{RunID: run.ID, Mode: run.Mode, RunResult: result})
+}
+
+func fireRunCompletedWebhook(ctx context.Context, run *Run) {
+	data := RunWebhookData{
+		RunID:     run.ID,
+		Mode:      run.Mode,
+		Source:    run.Source,
+		Operator:  run.Operator,
+		Created:   run.Created,
+		Processed: run.Processed,
+		Failed:    run.Failed,
+	}
+	for _, result := range run.Results {
+		if result.Status == "processed" {
+			data.ProcessedAmount += math.Abs(result.Amount)
+		} else {
+			data.FailedAmount += math.Abs(result.Amount)
+		}
+	}
+	fireWebhook(ctx, webhookRunCompleted, data)
+}
+
+// fireWebhook logs one delivery per configured URL and sends them in the
+// background so a slow receiver never holds up a run.
+func fireWebhook(ctx context.Context, event string, data interface{}) {
+	urls := webhookURLs()
+	if len(urls) == 0 || !webhookEventEnabled(event) {
+		return
+	}
+
+	for _, u := range urls {
+		id := newDeliveryID()
+		payload, err := json.Marshal(WebhookPayload{ID: id, Event: event, CreatedAt: time.Now(), Data: data})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to encode webhook", "event", event, "error", err)
+			return
+		}
+
+		delivery := &WebhookDelivery{
+			ID:        id,
+			Event:     event,
+			URL:       u,
+			Payload:   payload,
+			Status:    "pending",
+			CreatedAt: time.Now(),
+		}
+		if err := deliveryStore.Save(delivery); err != nil {
+			slog.ErrorContext(ctx, "Failed to record webhook delivery", "delivery_id", id, "error", err)
+		}
+
+		webhookWG.Add(1)
+		go func() {
+			defer webhookWG.Done()
+			deliverWebhook(context.WithoutCancel(ctx), delivery)
+		}()
+	}
+}
+
+// redeliverWebhook sends a logged delivery again with its original payload.
+func redeliverWebhook(ctx context.Context, id string) (*WebhookDelivery, error) {
+	delivery, err := deliveryStore.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	delivery.Status = "pending"
+	deliverWebhook(ctx, delivery)
+	return delivery, nil
+}
+
+// deliverWebhook POSTs the payload, retrying with exponential backoff until
+// the receiver answers 2xx or the attempts run out. Every attempt is logged.
+func deliverWebhook(ctx context.Context, delivery *WebhookDelivery) {
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(webhookBackoff * time.Duration(1<<(attempt-2)))
+		}
+
+		result := sendWebhook(delivery)
+		delivery.Attempts = append(delivery.Attempts, result)
+		if result.Error == "" {
+			delivery.Status = "delivered"
+		} else if attempt == webhookMaxAttempts {
+			delivery.Status = "failed"
+			slog.ErrorContext(ctx, "Webhook delivery failed", "delivery_id", delivery.ID, "event", delivery.Event,
+				"url", delivery.URL, "attempts", attempt, "error", result.Error)
+		}
+
+		if err := deliveryStore.Save(delivery); err != nil {
+			slog.ErrorContext(ctx, "Failed to record webhook delivery", "delivery_id", delivery.ID, "error", err)
+		}
+		if delivery.Status == "delivered" {
+			return
+		}
+	}
+}
+
+func sendWebhook(delivery *WebhookDelivery) WebhookAttempt {
+	start := time.Now()
+	attempt := WebhookAttempt{At: start}
+
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewBuffer(delivery.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cash-Cannon-Event", delivery.Event)
+	req.Header.Set("X-Cash-Cannon-Delivery", delivery.ID)
+	req.Header.Set("X-Cash-Cannon-Timestamp", timestamp)
+	req.Header.Set("X-Cash-Cannon-Signature", signWebhook(timestamp, delivery.Payload))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		attempt.Error = fmt.Sprintf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return attempt
+}
+
+func signWebhook(timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("WEBHOOK_SECRET")))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newDeliveryID() string {
+	return "whd_" + strings.TrimPrefix(newRunID(), "run_")
+}